@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -136,6 +137,7 @@ func (ctx *bootContext) startClient() {
 	)
 
 	client := NewClient(ctx.cman)
+	client.Subscribe(terminateOnFatal(client))
 	addr := ctx.cman.ListenAddr(SR_CLIENT)
 
 	ln, err = net.ListenTCP("tcp", addr)
@@ -146,8 +148,42 @@ func (ctx *bootContext) startClient() {
 	log.Infoln(versionString())
 	log.Infoln("Proxy(SOCKS5/HTTP) is listening on", addr)
 
+	if tpAddr := ctx.cman.TransparentAddr(); tpAddr != nil {
+		tpLn, err := net.ListenTCP("tcp", tpAddr)
+		fatalError(err)
+		defer tpLn.Close()
+		ctx.closeable = append(ctx.closeable, tpLn)
+		log.Infoln("Transparent proxy is listening on", tpAddr)
+		go acceptLoop(tpLn, client.TransparentServe)
+	}
+
+	if dnsAddr := ctx.cman.DNSAddr(); dnsAddr != nil {
+		dnsLn, err := net.ListenTCP("tcp", dnsAddr)
+		fatalError(err)
+		defer dnsLn.Close()
+		dnsConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: dnsAddr.IP, Port: dnsAddr.Port, Zone: dnsAddr.Zone})
+		fatalError(err)
+		defer dnsConn.Close()
+		ctx.closeable = append(ctx.closeable, dnsLn, dnsConn)
+		log.Infoln("DNS is listening on", dnsAddr)
+		go acceptLoop(dnsLn, client.DNSServe)
+		go client.DNSPacketServe(dnsConn)
+	}
+
+	for _, fwd := range ctx.cman.LocalForwards() {
+		fwdLn, err := net.ListenTCP("tcp", fwd.ListenAddr)
+		fatalError(err)
+		defer fwdLn.Close()
+		ctx.closeable = append(ctx.closeable, fwdLn)
+		log.Infoln("Forward", fwd)
+		target := fwd.Target
+		go acceptLoop(fwdLn, func(conn *net.TCPConn) {
+			client.ForwardServe(conn, target)
+		})
+	}
+
 	// connect to server
-	go client.StartTun(true)
+	client.Start()
 
 	for {
 		conn, err = ln.AcceptTCP()
@@ -159,20 +195,26 @@ func (ctx *bootContext) startClient() {
 	}
 }
 
+// accept connections of the additional listeners until closed
+func acceptLoop(ln *net.TCPListener, handle func(*net.TCPConn)) {
+	for {
+		conn, err := ln.AcceptTCP()
+		if err == nil {
+			go handle(conn)
+		} else if IsClosedError(err) {
+			return
+		}
+	}
+}
+
 func (ctx *bootContext) startServer() {
 	defer func() {
 		sigChan <- Bye
 	}()
-	var (
-		conn *net.TCPConn
-		ln   *net.TCPListener
-		err  error
-	)
-
 	server := NewServer(ctx.cman)
 	addr := ctx.cman.ListenAddr(SR_SERVER)
 
-	ln, err = net.ListenTCP("tcp", addr)
+	ln, err := net.ListenTCP("tcp", addr)
 	fatalError(err)
 	defer ln.Close()
 
@@ -180,13 +222,9 @@ func (ctx *bootContext) startServer() {
 	log.Infoln(versionString())
 	log.Infoln("Server is listening on", addr)
 
-	for {
-		conn, err = ln.AcceptTCP()
-		if err == nil {
-			go server.TunnelServe(conn)
-		} else {
-			SafeClose(conn)
-		}
+	err = server.Serve(ln)
+	if err != ERR_SERVER_CLOSED && !IsClosedError(err) {
+		log.Errorln(err)
 	}
 }
 
@@ -262,6 +300,29 @@ func fatalError(err error, args ...interface{}) {
 	}
 }
 
+// the client couldn't recover from these errors by retrying
+// the failed server will be offline, and exit once all of them failed.
+func terminateOnFatal(client *Client) StateListener {
+	return func(ev *StateEvent) {
+		var exitCode int
+		switch {
+		case errors.Is(ev.Err, ErrPreAuth):
+			exitCode = 2
+		case errors.Is(ev.Err, ErrIncompatibleVersion):
+			exitCode = 3
+		}
+		if exitCode > 0 {
+			line := strings.Repeat("+", 30)
+			log.Warningln(line)
+			log.Warningln(ev.Server, ev.Err)
+			log.Warningln(line)
+			if client.Unrecoverable() {
+				os.Exit(exitCode)
+			}
+		}
+	}
+}
+
 func fatalAndCommandHelp(c *cli.Context) {
 	// app root
 	if c.Parent() == nil {
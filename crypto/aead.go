@@ -0,0 +1,28 @@
+package crypto
+
+import (
+	"crypto/cipher"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// NewChaCha20Poly1305 returns the ChaCha20-Poly1305 AEAD of RFC 7539.
+func NewChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	if len(key) != CHACHA_KEY_SIZE {
+		return nil, KeySizeError(len(key))
+	}
+	return chacha20poly1305.New(key)
+}
+
+// extends the slice by n bytes and returns the whole and the extended part,
+// then the AEAD could append to dst as the standard ones.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
@@ -194,45 +194,60 @@ func (a *AES_GCM) Overhead() int {
 	return EVP_AEAD_AES_GCM_TAG_LEN
 }
 
+// the result is appended to dst as cipher.AEAD,
+// and dst could be plaintext[:0] for sealing in place.
 func (a *AES_GCM) Seal(dst, nonce, plaintext, data []byte) []byte {
-	// TODO check args
-	c_in := (*C.uint8_t)(unsafe.Pointer(&plaintext[0]))
-	c_out := (*C.uint8_t)(unsafe.Pointer(&dst[0]))
-	c_nonce := (*C.uint8_t)(unsafe.Pointer(&nonce[0]))
-	var c_ad *C.uint8_t
+	if len(nonce) != EVP_AEAD_AES_GCM_NONCE_LEN {
+		panic(ERR_BAD_IV_LENGTH)
+	}
+	ret, out := sliceForAppend(dst, len(plaintext)+EVP_AEAD_AES_GCM_TAG_LEN)
+	var c_in, c_ad *C.uint8_t
+	if len(plaintext) > 0 {
+		c_in = (*C.uint8_t)(unsafe.Pointer(&plaintext[0]))
+	}
 	if len(data) > 0 {
 		c_ad = (*C.uint8_t)(unsafe.Pointer(&data[0]))
 	}
+	c_out := (*C.uint8_t)(unsafe.Pointer(&out[0]))
+	c_nonce := (*C.uint8_t)(unsafe.Pointer(&nonce[0]))
 	var out_len C.size_t
-	ret := C.EVP_AEAD_CTX_seal(a.ctx,
-		c_out, &out_len, C.size_t(len(dst)),
+	ret_code := C.EVP_AEAD_CTX_seal(a.ctx,
+		c_out, &out_len, C.size_t(len(out)),
 		c_nonce, C.size_t(len(nonce)),
 		c_in, C.size_t(len(plaintext)),
 		c_ad, C.size_t(len(data)))
-	if ret == bssl_ok {
-		return dst[:int(out_len)]
+	if ret_code == bssl_ok {
+		return ret[:len(dst)+int(out_len)]
 	} else {
 		panic(get_error())
 	}
 }
 
+// the result is appended to dst as cipher.AEAD,
+// and dst could be ciphertext[:0] for opening in place.
 func (a *AES_GCM) Open(dst, nonce, ciphertext, data []byte) ([]byte, error) {
-	// TODO check args
-	c_in := (*C.uint8_t)(unsafe.Pointer(&ciphertext[0]))
-	c_out := (*C.uint8_t)(unsafe.Pointer(&dst[0]))
-	c_nonce := (*C.uint8_t)(unsafe.Pointer(&nonce[0]))
+	if len(nonce) != EVP_AEAD_AES_GCM_NONCE_LEN {
+		return nil, ERR_BAD_IV_LENGTH
+	}
+	if len(ciphertext) < EVP_AEAD_AES_GCM_TAG_LEN {
+		return nil, ERR_AEAD_OPEN
+	}
+	ret, out := sliceForAppend(dst, len(ciphertext))
 	var c_ad *C.uint8_t
 	if len(data) > 0 {
 		c_ad = (*C.uint8_t)(unsafe.Pointer(&data[0]))
 	}
+	c_in := (*C.uint8_t)(unsafe.Pointer(&ciphertext[0]))
+	c_out := (*C.uint8_t)(unsafe.Pointer(&out[0]))
+	c_nonce := (*C.uint8_t)(unsafe.Pointer(&nonce[0]))
 	var out_len C.size_t
-	ret := C.EVP_AEAD_CTX_open(a.ctx,
-		c_out, &out_len, C.size_t(len(dst)),
+	ret_code := C.EVP_AEAD_CTX_open(a.ctx,
+		c_out, &out_len, C.size_t(len(out)),
 		c_nonce, C.size_t(len(nonce)),
 		c_in, C.size_t(len(ciphertext)),
 		c_ad, C.size_t(len(data)))
-	if ret == bssl_ok {
-		return dst[:int(out_len)], nil
+	if ret_code == bssl_ok {
+		return ret[:len(dst)+int(out_len)], nil
 	} else {
 		return nil, fmt.Errorf(get_error())
 	}
@@ -47,6 +47,19 @@ func NewAESDecrypter(block cipher.Block, iv []byte) (cipher.Stream, error) {
 	return nil, ERR_NOT_IMPLEMENTED
 }
 
+func NewAES_GCM(key []byte) (cipher.AEAD, error) {
+	switch len(key) {
+	case 16, 32:
+	default:
+		return nil, ERR_BAD_KEY_LENGTH
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 // compat impl.
 func HasAESHardware() int {
 	return 0
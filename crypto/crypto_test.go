@@ -144,7 +144,7 @@ func Benchmark_AES128_gcm(b *testing.B) {
 	b.SetBytes(int64(len(sample)))
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		ec.Seal(out, iv, sample, nil)
+		ec.Seal(out[:0], iv, sample, nil)
 	}
 }
 
@@ -155,7 +155,7 @@ func Benchmark_AES256_gcm(b *testing.B) {
 	b.SetBytes(int64(len(sample)))
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		ec.Seal(out, iv, sample, nil)
+		ec.Seal(out[:0], iv, sample, nil)
 	}
 }
 
@@ -253,9 +253,9 @@ func Test_AES_GCM(t *testing.T) {
 	out2 := make([]byte, len(out1))
 
 	ec, dc, iv := new_aes_gcm(128)
-	out1 = ec.Seal(out1, iv, plain, nil)
+	out1 = ec.Seal(out1[:0], iv, plain, nil)
 
-	out2, err := dc.Open(out2, iv, out1, nil)
+	out2, err := dc.Open(out2[:0], iv, out1, nil)
 	// assertion
 	if dumpDiff(plain, out2) {
 		t.Logf("plain=%d Seal=%d Open=%d", len(plain), len(out1), len(out2))
@@ -263,6 +263,25 @@ func Test_AES_GCM(t *testing.T) {
 	}
 }
 
+func Test_DHKE(t *testing.T) {
+	for _, name := range []string{"X25519", "ECC-P256", "ECC-P521", "DHE"} {
+		alice, err := NewDHKey(name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		bob, _ := NewDHKey(name)
+		k1, err1 := alice.ComputeKey(bob.ExportPubKey())
+		k2, err2 := bob.ComputeKey(alice.ExportPubKey())
+		if err1 != nil || err2 != nil || !bytes.Equal(k1, k2) {
+			t.Fatalf("%s inconsistent key %v %v", name, err1, err2)
+		}
+	}
+	x, _ := NewDHKey("X25519")
+	if _, err := x.ComputeKey(make([]byte, 32)); err == nil {
+		t.Fatal("X25519 accepted the low order point")
+	}
+}
+
 func test_correctness(t *testing.T, ec, dc cipher.Stream, sample2, origin2 []byte) {
 	// n-times encrypt, then decrypt all onetime.
 	randSlice(sample2, ec.XORKeyStream)
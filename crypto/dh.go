@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"crypto/ecdh"
 	"crypto/elliptic"
 	"crypto/rand"
 	"math/big"
@@ -35,11 +36,14 @@ func SelectCurve(name string) (elliptic.Curve, error) {
 	return curve, nil
 }
 
-// enum: DHE, ECC-P224,256,384,521
+// enum: X25519, DHE, ECC-P224,256,384,521
 func NewDHKey(name string) (DHKE, error) {
 	name = strings.ToUpper(name)
-	if name == "DHE" {
+	switch name {
+	case "DHE":
 		return GenerateDHEKey()
+	case "X25519":
+		return GenerateX25519Key()
 	}
 	curve, err := SelectCurve(name)
 	if err != nil {
@@ -132,3 +136,29 @@ func (d *DHEKey) ComputeKey(pub []byte) ([]byte, error) {
 	}
 	return nil, e
 }
+
+// Ref: https://tools.ietf.org/html/rfc7748
+type X25519Key struct {
+	priv *ecdh.PrivateKey
+}
+
+func GenerateX25519Key() (*X25519Key, error) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Key{k}, nil
+}
+
+func (k *X25519Key) ExportPubKey() []byte {
+	return k.priv.PublicKey().Bytes()
+}
+
+func (k *X25519Key) ComputeKey(bobPub []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(bobPub)
+	if err != nil {
+		return nil, InvalidECCParam
+	}
+	// the low order point results in error
+	return k.priv.ECDH(pub)
+}
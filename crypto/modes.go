@@ -29,6 +29,7 @@ var (
 	ERR_BAD_KEY_LENGTH  = errors.New("BAD_KEY_LENGTH")
 	ERR_BAD_IV_LENGTH   = errors.New("BAD_IV_LENGTH")
 	ERR_NOT_IMPLEMENTED = errors.New("ERR_NOT_IMPLEMENTED")
+	ERR_AEAD_OPEN       = errors.New("AEAD_OPEN_FAILED")
 )
 
 const (
@@ -111,7 +111,7 @@ OPTIONS:
 const _csc_examples = `
    ./deblocus csc > deblocus.ini
    ./deblocus csc -o deblocus.ini
-   ./deblocus csc -t [ECC-P224,256,384,521 | RSA-1024,2048,4096]`
+   ./deblocus csc -t [ECC-P224,256,384,521 | RSA-1024,2048,4096 | ED25519]`
 
 const _ccc_examples = `
    ./deblocus ccc --addr=example.com:9008  user
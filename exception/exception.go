@@ -30,6 +30,16 @@ func (e *Exception) Apply(extra interface{}) *Exception {
 	}
 }
 
+// for errors.Is, matches any of the origins
+func (e *Exception) Is(target error) bool {
+	for x := e; x != nil; x = x.Origin {
+		if x == target {
+			return true
+		}
+	}
+	return false
+}
+
 func New(msg string) *Exception {
 	return &Exception{msg: msg}
 }
@@ -119,7 +119,12 @@ func (f *GeoIPFilter) Filter(host string) bool {
 		return false
 	}
 
-	ipv4 := ipAddr.IP.To4()
+	return f.Match(ipAddr.IP)
+}
+
+// whether the ip belongs to the country of keyword
+func (f *GeoIPFilter) Match(ip net.IP) bool {
+	ipv4 := ip.To4()
 	if ipv4 == nil { // not a ipv4 addr
 		return false
 	}
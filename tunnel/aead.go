@@ -0,0 +1,142 @@
+package tunnel
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+
+	"github.com/Lafeng/deblocus/crypto"
+)
+
+// Every write is sealed into the records:
+// sealedLen~2+16 | sealedPayload~?+16
+// Each seal consumes a nonce of the sequence, that is iv xor seq,
+// and the sequences of two directions are separated by the highest bit.
+const (
+	AEAD_NONCE_LEN   = 12
+	AEAD_TAG_LEN     = 16
+	AEAD_MAX_PAYLOAD = 0x3fff
+	AEAD_SEQ_SERVER  = uint64(1) << 63
+)
+
+type AEADCipherKit struct {
+	aead   cipher.AEAD
+	iv     []byte
+	encSeq uint64
+	decSeq uint64
+	wbuf   []byte
+	rbuf   []byte
+	rn     int    // received length in rbuf
+	rsize  int    // opened payload length, -1 for reading the length
+	plain  []byte // opened but unconsumed
+	err    error  // authentication failure is permanent
+}
+
+func newAEADCipherKit(aead cipher.AEAD, iv []byte) *AEADCipherKit {
+	return &AEADCipherKit{
+		aead:   aead,
+		iv:     append([]byte(nil), iv...),
+		decSeq: AEAD_SEQ_SERVER, // as client
+		rbuf:   make([]byte, AEAD_MAX_PAYLOAD+AEAD_TAG_LEN),
+		rsize:  -1,
+	}
+}
+
+// the server writes with the upper half sequence
+func (c *AEADCipherKit) setServer() {
+	c.encSeq, c.decSeq = c.decSeq, c.encSeq
+}
+
+func (c *AEADCipherKit) nextNonce(nonce []byte, seq *uint64) []byte {
+	copy(nonce, c.iv)
+	binary.BigEndian.PutUint64(nonce[4:], binary.BigEndian.Uint64(c.iv[4:])^*seq)
+	*seq++
+	return nonce
+}
+
+func (c *AEADCipherKit) write(w io.Writer, b []byte) (int, error) {
+	var nonce = make([]byte, AEAD_NONCE_LEN)
+	var size = make([]byte, 2)
+	var buf = c.wbuf[:0]
+	for p := b; len(p) > 0; {
+		var chunk = p
+		if len(chunk) > AEAD_MAX_PAYLOAD {
+			chunk = chunk[:AEAD_MAX_PAYLOAD]
+		}
+		p = p[len(chunk):]
+		binary.BigEndian.PutUint16(size, uint16(len(chunk)))
+		buf = c.aead.Seal(buf, c.nextNonce(nonce, &c.encSeq), size, nil)
+		buf = c.aead.Seal(buf, c.nextNonce(nonce, &c.encSeq), chunk, nil)
+	}
+	c.wbuf = buf
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if _, err := w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *AEADCipherKit) read(r io.Reader, b []byte) (n int, err error) {
+	if len(c.plain) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.plain, err = c.readRecord(r); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return
+}
+
+// the progress will be kept if reading was interrupted by timeout
+func (c *AEADCipherKit) readRecord(r io.Reader) ([]byte, error) {
+	var nonce = make([]byte, AEAD_NONCE_LEN)
+	if c.rsize < 0 {
+		if err := c.fill(r, 2+AEAD_TAG_LEN); err != nil {
+			return nil, err
+		}
+		size, err := c.aead.Open(c.rbuf[:0], c.nextNonce(nonce, &c.decSeq), c.rbuf[:2+AEAD_TAG_LEN], nil)
+		if err != nil {
+			return nil, c.fail(err)
+		}
+		c.rsize, c.rn = int(binary.BigEndian.Uint16(size)), 0
+		if c.rsize > AEAD_MAX_PAYLOAD {
+			return nil, c.fail(c.rsize)
+		}
+	}
+	if err := c.fill(r, c.rsize+AEAD_TAG_LEN); err != nil {
+		return nil, err
+	}
+	plain, err := c.aead.Open(c.rbuf[:0], c.nextNonce(nonce, &c.decSeq), c.rbuf[:c.rsize+AEAD_TAG_LEN], nil)
+	if err != nil {
+		return nil, c.fail(err)
+	}
+	c.rsize, c.rn = -1, 0
+	return plain, nil
+}
+
+func (c *AEADCipherKit) fill(r io.Reader, size int) error {
+	for c.rn < size {
+		n, err := r.Read(c.rbuf[c.rn:size])
+		c.rn += n
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *AEADCipherKit) fail(detail interface{}) error {
+	c.err = ERR_DATA_TAMPERED.Apply(detail)
+	return c.err
+}
+
+func (c *AEADCipherKit) Cleanup() {
+	crypto.Memset(c.iv, 0)
+	crypto.Memset(c.rbuf, 0)
+	c.plain = nil
+}
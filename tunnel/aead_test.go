@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newAEADPair(name string) (client, server *Conn, raw net.Conn) {
+	var iv = randArray(32)
+	var cf = NewCipherFactory(name, []byte("aead"))
+	c, s := net.Pipe()
+	client, server = NewConn(c, nil), NewConn(s, nil)
+	client.SetupCipher(cf, iv, false)
+	server.SetupCipher(cf, iv, true)
+	return client, server, c
+}
+
+func TestAEADCipher(t *testing.T) {
+	for _, name := range []string{"AES128GCM", "AES256GCM", "CHACHA20POLY1305"} {
+		client, server, _ := newAEADPair(name)
+		// large write is split into records
+		var data = make([]byte, 1<<17)
+		randomBuffer(data)
+		for _, pair := range [][2]*Conn{{client, server}, {server, client}} {
+			go pair[0].Write(append([]byte(nil), data...))
+			var recv = make([]byte, len(data))
+			if _, e := io.ReadFull(pair[1], recv); e != nil || !bytes.Equal(recv, data) {
+				t.Errorf("%s records mismatched error=%v", name, e)
+			}
+		}
+		// the ciphertext is different in two directions
+		var kc, ks = client.cipher.(*duplexCipherKit).w.(*AEADCipherKit), server.cipher.(*duplexCipherKit).w.(*AEADCipherKit)
+		if kc.encSeq != ks.decSeq || kc.encSeq&AEAD_SEQ_SERVER != 0 || ks.encSeq&AEAD_SEQ_SERVER == 0 {
+			t.Errorf("%s sequences client=%x server=%x", name, kc.encSeq, ks.encSeq)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestAEADTampered(t *testing.T) {
+	client, server, raw := newAEADPair("AES128GCM")
+	defer server.Close()
+	var msg = []byte("hello aead")
+
+	// timeout in the middle of a record
+	var record = new(bytes.Buffer)
+	client.cipher.write(record, append([]byte(nil), msg...))
+	var sealed = record.Bytes()
+	go raw.Write(sealed[:5])
+	var buf = make([]byte, len(msg))
+	server.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, e := server.Read(buf); !IsTimeout(e) {
+		t.Fatal("expected timeout but", e)
+	}
+	go raw.Write(sealed[5:])
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, e := io.ReadFull(server, buf); e != nil || !bytes.Equal(buf, msg) {
+		t.Errorf("resumed record %q error=%v", buf, e)
+	}
+
+	// replayed or modified records
+	var kit = server.cipher.(*duplexCipherKit).r.(*AEADCipherKit)
+	sealed = kit.aead.Seal(nil, make([]byte, AEAD_NONCE_LEN), []byte{0, 1}, nil)
+	go raw.Write(sealed)
+	if _, e := server.Read(buf); !errors.Is(e, ERR_DATA_TAMPERED) {
+		t.Errorf("expected tampered but %v", e)
+	}
+	// permanently
+	if _, e := server.Read(buf); !errors.Is(e, ERR_DATA_TAMPERED) {
+		t.Errorf("expected tampered but %v", e)
+	}
+}
@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// A bounded map of the values with expiry times.
+// When it was filled up, the stale ones will be dropped at first,
+// or an arbitrary one if all of them were fresh.
+type expiringCache struct {
+	lock     sync.Mutex
+	capacity int
+	entries  map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value  interface{}
+	expire time.Time
+}
+
+func newExpiringCache(capacity int) *expiringCache {
+	return &expiringCache{
+		capacity: capacity,
+		entries:  make(map[string]cacheEntry),
+	}
+}
+
+// the value which was not expired
+func (c *expiringCache) get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, y := c.entries[key]
+	if !y {
+		return nil, false
+	}
+	if time.Now().After(e.expire) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *expiringCache) set(key string, value interface{}, expire time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, y := c.entries[key]; !y && len(c.entries) >= c.capacity {
+		c.evictLocked()
+	}
+	c.entries[key] = cacheEntry{value, expire}
+}
+
+func (c *expiringCache) evictLocked() {
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expire) {
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < c.capacity {
+			break
+		}
+		delete(c.entries, k)
+	}
+}
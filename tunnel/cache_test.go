@@ -0,0 +1,28 @@
+package tunnel
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpiringCache(t *testing.T) {
+	c := newExpiringCache(4)
+	c.set("stale", 1, time.Now().Add(-time.Second))
+	if _, y := c.get("stale"); y {
+		t.Errorf("got the stale")
+	}
+	c.set("a", 1, time.Now().Add(-time.Second))
+	for i := 0; i < 4; i++ {
+		c.set(strconv.Itoa(i), i, time.Now().Add(time.Minute))
+	}
+	// the stale was dropped at first
+	if v, y := c.get("0"); !y || v != 0 || len(c.entries) != 4 {
+		t.Errorf("got %v %v len=%d", v, y, len(c.entries))
+	}
+	// bounded
+	c.set("4", 4, time.Now().Add(time.Minute))
+	if v, y := c.get("4"); !y || v != 4 || len(c.entries) != 4 {
+		t.Errorf("got %v %v len=%d", v, y, len(c.entries))
+	}
+}
@@ -5,9 +5,11 @@ import (
 	stdcrypto "crypto"
 	"crypto/cipher"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
 	"encoding/asn1"
 	"fmt"
@@ -23,7 +25,7 @@ var (
 	UNSUPPORTED_CIPHER = exception.New("Unsupported cipher")
 )
 
-type cipherBuilder func(k, iv []byte) *XORCipherKit
+type cipherBuilder func(k, iv []byte) cipherKit
 
 type cipherDesc struct {
 	keyLen  int
@@ -31,9 +33,11 @@ type cipherDesc struct {
 	builder cipherBuilder
 }
 
+// the stream ciphers transform the data in place,
+// and the AEAD ciphers seal the data into records.
 type cipherKit interface {
-	encrypt(dst, src []byte)
-	decrypt(dst, src []byte)
+	read(r io.Reader, b []byte) (int, error)
+	write(w io.Writer, b []byte) (int, error)
 	Cleanup()
 }
 
@@ -42,12 +46,18 @@ type XORCipherKit struct {
 	dec cipher.Stream
 }
 
-func (c *XORCipherKit) encrypt(dst, src []byte) {
-	c.enc.XORKeyStream(dst, src)
+func (c *XORCipherKit) read(r io.Reader, b []byte) (int, error) {
+	n, err := r.Read(b)
+	if n > 0 {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
 }
 
-func (c *XORCipherKit) decrypt(dst, src []byte) {
-	c.dec.XORKeyStream(dst, src)
+// b will be encrypted in place
+func (c *XORCipherKit) write(w io.Writer, b []byte) (int, error) {
+	c.enc.XORKeyStream(b, b)
+	return w.Write(b)
 }
 
 func (c *XORCipherKit) Cleanup() {
@@ -61,9 +71,9 @@ func (c *XORCipherKit) Cleanup() {
 
 type NullCipherKit byte
 
-func (c *NullCipherKit) encrypt(dst, src []byte) {}
-func (c *NullCipherKit) decrypt(dst, src []byte) {}
-func (c *NullCipherKit) Cleanup()                {}
+func (c *NullCipherKit) read(r io.Reader, b []byte) (int, error)  { return r.Read(b) }
+func (c *NullCipherKit) write(w io.Writer, b []byte) (int, error) { return w.Write(b) }
+func (c *NullCipherKit) Cleanup()                                 {}
 
 var nullCipherKit = new(NullCipherKit)
 
@@ -76,6 +86,10 @@ var availableCiphers = []interface{}{
 	"AES128CTR", &cipherDesc{16, 16, new_AES_CTR},
 	"AES192CTR", &cipherDesc{24, 16, new_AES_CTR},
 	"AES256CTR", &cipherDesc{32, 16, new_AES_CTR},
+	// AEAD
+	"AES128GCM", &cipherDesc{16, AEAD_NONCE_LEN, new_AES_GCM},
+	"AES256GCM", &cipherDesc{32, AEAD_NONCE_LEN, new_AES_GCM},
+	"CHACHA20POLY1305", &cipherDesc{32, AEAD_NONCE_LEN, new_ChaCha20Poly1305},
 }
 
 func GetAvailableCipher(wants string) (*cipherDesc, error) {
@@ -90,21 +104,21 @@ func GetAvailableCipher(wants string) (*cipherDesc, error) {
 	return nil, UNSUPPORTED_CIPHER.Apply(wants)
 }
 
-func new_AES_CTR(key, iv []byte) *XORCipherKit {
+func new_AES_CTR(key, iv []byte) cipherKit {
 	block, _ := crypto.NewAESCipher(key, crypto.MODE_CTR)
 	ec, _ := crypto.NewAESEncrypter(block, iv)
 	dc, _ := crypto.NewAESDecrypter(block, iv)
 	return &XORCipherKit{ec, dc}
 }
 
-func new_AES_OFB(key, iv []byte) *XORCipherKit {
+func new_AES_OFB(key, iv []byte) cipherKit {
 	block, _ := crypto.NewAESCipher(key, crypto.MODE_OFB)
 	ec, _ := crypto.NewAESEncrypter(block, iv)
 	dc, _ := crypto.NewAESDecrypter(block, iv)
 	return &XORCipherKit{ec, dc}
 }
 
-func new_ChaCha20(key, iv []byte) *XORCipherKit {
+func new_ChaCha20(key, iv []byte) cipherKit {
 	ec, e := crypto.NewChaCha(key, iv, crypto.CHACHA20_ROUND)
 	ThrowErr(e)
 	dc, e := crypto.NewChaCha(key, iv, crypto.CHACHA20_ROUND)
@@ -112,7 +126,7 @@ func new_ChaCha20(key, iv []byte) *XORCipherKit {
 	return &XORCipherKit{ec, dc}
 }
 
-func new_ChaCha12(key, iv []byte) *XORCipherKit {
+func new_ChaCha12(key, iv []byte) cipherKit {
 	ec, e := crypto.NewChaCha(key, iv, crypto.CHACHA12_ROUND)
 	ThrowErr(e)
 	dc, e := crypto.NewChaCha(key, iv, crypto.CHACHA12_ROUND)
@@ -120,12 +134,24 @@ func new_ChaCha12(key, iv []byte) *XORCipherKit {
 	return &XORCipherKit{ec, dc}
 }
 
+func new_AES_GCM(key, iv []byte) cipherKit {
+	aead, e := crypto.NewAES_GCM(key)
+	ThrowErr(e)
+	return newAEADCipherKit(aead, iv)
+}
+
+func new_ChaCha20Poly1305(key, iv []byte) cipherKit {
+	aead, e := crypto.NewChaCha20Poly1305(key)
+	ThrowErr(e)
+	return newAEADCipherKit(aead, iv)
+}
+
 type CipherFactory struct {
 	key  []byte
 	decr *cipherDesc
 }
 
-func (c *CipherFactory) InitCipher(iv []byte) *XORCipherKit {
+func (c *CipherFactory) InitCipher(iv []byte, isServ bool) cipherKit {
 	if iv == nil {
 		panic("iv nil") // TODO test
 	}
@@ -134,7 +160,11 @@ func (c *CipherFactory) InitCipher(iv []byte) *XORCipherKit {
 	} else {
 		iv = iv[:c.decr.ivLen]
 	}
-	return c.decr.builder(c.key, iv)
+	kit := c.decr.builder(c.key, iv)
+	if aead, y := kit.(*AEADCipherKit); y && isServ {
+		aead.setServer()
+	}
+	return kit
 }
 
 func (f *CipherFactory) Cleanup() {
@@ -162,6 +192,8 @@ func NameOfKey(v interface{}) string {
 		return fmt.Sprintf("ECC-P%d", k.Params().BitSize)
 	case *rsa.PublicKey:
 		return fmt.Sprintf("RSA-%d", k.N.BitLen())
+	case ed25519.PublicKey:
+		return "ED25519"
 	}
 	return NULL
 }
@@ -176,6 +208,9 @@ func FingerprintOfKey(v interface{}) string {
 	case *rsa.PublicKey:
 		buf.Write(k.N.Bytes())
 		buf.WriteRune(rune(k.E))
+	case ed25519.PublicKey:
+		buf.WriteString("ED25519")
+		buf.Write(k)
 	}
 	hs := hash128(buf.Bytes())
 	return strings.Replace(fmt.Sprintf("% x", hs), " ", ":", -1)
@@ -185,8 +220,11 @@ func GenerateDSAKey(name string) (stdcrypto.PrivateKey, error) {
 	if name == NULL {
 		name = "ECC-P256"
 	}
-	kType, opt := SubstringBefore(name, "-")
+	kType, opt := SubstringBefore(strings.ToUpper(name), "-")
 	switch kType {
+	case "ED25519":
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
 	case "RSA":
 		switch opt {
 		case "1024":
@@ -212,6 +250,8 @@ func MarshalPrivateKey(priv stdcrypto.PrivateKey) (b []byte) {
 		b = x509.MarshalPKCS1PrivateKey(k)
 	case *ecdsa.PrivateKey:
 		b, _ = x509.MarshalECPrivateKey(k)
+	case ed25519.PrivateKey:
+		b, _ = x509.MarshalPKCS8PrivateKey(k)
 	}
 	return
 }
@@ -223,6 +263,11 @@ func UnmarshalPrivateKey(b []byte) (stdcrypto.PrivateKey, error) {
 	if k, err := x509.ParsePKCS1PrivateKey(b); err == nil {
 		return k, nil
 	}
+	if k, err := x509.ParsePKCS8PrivateKey(b); err == nil {
+		if k, y := k.(ed25519.PrivateKey); y {
+			return k, nil
+		}
+	}
 	return nil, UNRECOGNIZED_SYMBOLS
 }
 
@@ -232,6 +277,8 @@ func preSharedKey(v interface{}) []byte {
 		return k.N.Bytes()
 	case *ecdsa.PublicKey:
 		return k.X.Bytes()
+	case ed25519.PublicKey:
+		return k
 	}
 	panic(UNSUPPORTED_CIPHER)
 }
@@ -252,26 +299,34 @@ type ecdsaSignature struct {
 	R, S *big.Int
 }
 
+// the msg is hashed by sha512 before signing except ed25519
 func DSAVerify(pub stdcrypto.PublicKey, sig, msg []byte) bool {
+	hashed := sha512.Sum512(msg)
 	switch k := pub.(type) {
 	case *rsa.PublicKey:
 		// rsa.go:L87 SignPKCS1v15
-		return nil == rsa.VerifyPKCS1v15(k, stdcrypto.SHA512, msg, sig)
+		return nil == rsa.VerifyPKCS1v15(k, stdcrypto.SHA512, hashed[:], sig)
 	case *ecdsa.PublicKey:
 		var es ecdsaSignature
 		_, err := asn1.Unmarshal(sig, &es)
 		if err != nil {
 			return false
 		}
-		return ecdsa.Verify(k, msg, es.R, es.S)
+		return ecdsa.Verify(k, hashed[:], es.R, es.S)
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, msg, sig)
 	}
 	panic(UNSUPPORTED_CIPHER)
 }
 
 func DSASign(priv stdcrypto.PrivateKey, msg []byte) []byte {
+	if k, y := priv.(ed25519.PrivateKey); y {
+		return ed25519.Sign(k, msg)
+	}
 	if signer, y := priv.(stdcrypto.Signer); y {
 		// arg3:SignerOpts for rsa
-		b, err := signer.Sign(rand.Reader, msg, stdcrypto.SHA512)
+		hashed := sha512.Sum512(msg)
+		b, err := signer.Sign(rand.Reader, hashed[:], stdcrypto.SHA512)
 		ThrowErr(err)
 		return b
 	}
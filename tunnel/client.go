@@ -1,27 +1,27 @@
 package tunnel
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
+	"github.com/Lafeng/deblocus/auth"
 	ex "github.com/Lafeng/deblocus/exception"
 	log "github.com/Lafeng/deblocus/glog"
 )
 
 const (
-	DT_PING_INTERVAL = 110
-	RETRY_INTERVAL   = time.Second * 5
-	REST_INTERVAL    = RETRY_INTERVAL
-)
-
-const (
-	CLT_CLOSED  int32 = -1
-	CLT_WORKING int32 = 0
-	CLT_PENDING int32 = 1
+	DT_PING_INTERVAL    = 110
+	RETRY_INTERVAL      = time.Second * 5
+	RETRY_BASE_INTERVAL = time.Second
+	RETRY_MAX_INTERVAL  = time.Minute * 5
+	REST_INTERVAL       = RETRY_INTERVAL
 )
 
 var (
@@ -29,138 +29,361 @@ var (
 	ERR_REQ_TK_ABORTED = ex.New("Requst token aborted")
 )
 
+// selection of servers
+const (
+	SERVER_FAILOVER = "Failover" // the first healthy one in order
+	SERVER_LATENCY  = "Latency"  // the healthy one with the lowest rtt
+	SERVER_BALANCE  = "Balance"  // spread new streams across healthy ones
+)
+
 type Client struct {
-	mux       *multiplexer
+	remotes   []*remote
+	mode      string
+	rrIndex   uint32
+	proxyAuth auth.AuthSys
+	reverse   []*ReverseForward
+	rules     *RuleSet
+	selection SelectionStrategy
+	weights   []int
+	pac       *pacGenerator
+	pacFile   string
+	dns       *dnsRelay
+	states    *stateHub
+	retryMax  time.Duration
+	rekey     rekeyLimit
+	reqCnt    int32
+}
+
+// a server with its own multiplexer and tokens
+type remote struct {
+	client    *Client
+	mux       unsafe.Pointer // *multiplexer, replaced by restart()
 	token     []byte
 	params    *tunParams
 	connInfo  *connectionInfo
 	lock      sync.Locker
 	dtCnt     int32
-	reqCnt    int32
-	state     int32
-	round     int32
+	fatal     int32 // failed fatally, then never retry
+	sm        *stateMachine
 	pendingTK *timedWait
 }
 
 func NewClient(cman *ConfigMan) *Client {
 	clt := &Client{
+		mode:      cman.cConf.ServerMode,
+		proxyAuth: cman.cConf.proxyAuth,
+		reverse:   cman.cConf.reverse,
+		rules:     cman.cConf.rules,
+		selection: cman.cConf.selection,
+		weights:   cman.cConf.weights,
+		pacFile:   cman.cConf.pacFile,
+		states:    newStateHub(),
+		retryMax:  cman.cConf.retryMax,
+		rekey:     cman.cConf.rekey,
+	}
+	if cman.cConf.DNSAddr != nil {
+		clt.dns = newClientDnsRelay()
+	}
+	if cman.cConf.pacAuto {
+		clt.pac = newPacGenerator(cman.cConf.Rules, clt.proxyAuth == nil)
+	}
+	for _, info := range cman.cConf.connInfos {
+		clt.remotes = append(clt.remotes, clt.newRemote(info))
+	}
+	return clt
+}
+
+func (c *Client) newRemote(info *connectionInfo) *remote {
+	r := &remote{
+		client:    c,
+		connInfo:  info,
 		lock:      new(sync.Mutex),
-		connInfo:  cman.cConf.connInfo,
-		state:     CLT_WORKING,
+		sm:        newStateMachine(info.sAddr, c.states),
 		pendingTK: NewTimedWait(false), // waiting tokens
 	}
-	return clt
+	r.setMux(newClientMultiplexer())
+	return r
+}
+
+// the request goroutines read it while restart() replaces it
+func (r *remote) getMux() *multiplexer {
+	return (*multiplexer)(atomic.LoadPointer(&r.mux))
+}
+
+func (r *remote) setMux(mux *multiplexer) {
+	atomic.StorePointer(&r.mux, unsafe.Pointer(mux))
+}
+
+// connect to all servers
+func (c *Client) Start() {
+	for _, r := range c.remotes {
+		go r.StartTun(0, true)
+	}
+}
+
+// select a server for the new request
+// the unhealthy ones will be skipped unless all of them were unavailable.
+func (c *Client) selectRemote() *remote {
+	var healthy []*remote
+	for _, r := range c.remotes {
+		if r.isHealthy() {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return c.remotes[0]
+	}
+	switch c.mode {
+	case SERVER_LATENCY:
+		var selected *remote
+		var rtt int32
+		for _, r := range healthy {
+			v := atomic.LoadInt32(&r.getMux().sRtt)
+			if v <= 0 { // unmeasured
+				v = 1<<31 - 1
+			}
+			if selected == nil || v < rtt {
+				selected, rtt = r, v
+			}
+		}
+		return selected
+	case SERVER_BALANCE:
+		i := atomic.AddUint32(&c.rrIndex, 1)
+		return healthy[int(i%uint32(len(healthy)))]
+	default:
+		return healthy[0]
+	}
+}
+
+func (c *Client) selectMux() *multiplexer {
+	return c.selectRemote().getMux()
+}
+
+// observe the state transitions of all servers
+func (c *Client) Subscribe(fn StateListener) (cancel func()) {
+	return c.states.subscribe(fn)
+}
+
+// the best state among the servers
+func (c *Client) State() ClientState {
+	var states = make(map[ClientState]bool)
+	for _, r := range c.remotes {
+		states[r.sm.current()] = true
+	}
+	for _, s := range []ClientState{CLT_SHUTTING_DOWN, CLT_ONLINE,
+		CLT_DEGRADED, CLT_AUTHENTICATING, CLT_CONNECTING} {
+		if states[s] {
+			return s
+		}
+	}
+	return CLT_OFFLINE
+}
+
+// true if all servers failed fatally, then the client should be terminated
+func (c *Client) Unrecoverable() bool {
+	for _, r := range c.remotes {
+		if atomic.LoadInt32(&r.fatal) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// the server couldn't be connected by retrying
+func isFatal(err error) bool {
+	return errors.Is(err, ErrPreAuth) || errors.Is(err, ErrIncompatibleVersion)
 }
 
-func (c *Client) initialConnect() (tun *Conn) {
+func (r *remote) initialConnect() (tun *Conn, err error) {
 	var theParam = new(tunParams)
-	var man = &d5cman{connectionInfo: c.connInfo}
-	var err error
+	var man = &d5cman{connectionInfo: r.connInfo}
+	man.connected = func() {
+		r.sm.transit(CLT_AUTHENTICATING)
+	}
 	tun, err = man.Connect(theParam)
-	if err != nil {
-		log.Errorf("Failed to connect to %s %s Retry after %s",
-			c.connInfo.RemoteName(), ex.Detail(err), RETRY_INTERVAL)
-		return nil
-	} else {
+	if err == nil {
 		log.Infof("Login to server %s with %s successfully",
-			c.connInfo.RemoteName(), c.connInfo.user)
-		c.params = theParam
-		c.token = theParam.token
-		return
+			r.connInfo.RemoteName(), r.connInfo.user)
+		r.params = theParam
+		r.token = theParam.token
 	}
+	return
 }
 
-func (c *Client) restart() (tun *Conn, rn int32) {
+// returns nil if shutting down
+func (r *remote) restart() (tun *Conn) {
+	var c = r.client
 	// discard requests are waiting for tokens
-	c.pendingTK.clearAll()
-	// release mux
-	if c.mux != nil {
+	r.pendingTK.clearAll()
+	if old := r.getMux(); old != nil {
 		// spin wait for all mux.Listen() goroutines exits
-		for atomic.LoadInt32(&c.dtCnt) > 0 {
+		for atomic.LoadInt32(&r.dtCnt) > 0 {
 			time.Sleep(time.Second)
 		}
-		c.mux.destroy()
+		// the server keeps the session for a while, see Session.offline
+		// then the suspended streams will be migrated to the resumed tun.
+		if token := r.takeToken(); token != nil &&
+			r.sm.transit(CLT_CONNECTING) && r.sm.transit(CLT_AUTHENTICATING) {
+			if tun = r.resumeTun(token); tun != nil {
+				return r.restarted(tun, false)
+			}
+			r.sm.transit(CLT_OFFLINE)
+		}
+		// release mux
+		old.destroy()
+	}
+	mux := newClientMultiplexer()
+	mux.pool.SetStrategy(c.selection)
+	mux.dns = c.dns
+	mux.rekey = c.rekey
+	mux.reverse = make(map[string]string)
+	for _, rev := range c.reverse {
+		mux.reverse[rev.Listen] = rev.Target
 	}
-	c.mux = newClientMultiplexer()
+	r.setMux(mux)
 	// try negotiating connection infinitely until success
-	for i := 0; tun == nil; i++ {
-		if i > 0 {
-			time.Sleep(RETRY_INTERVAL)
+	var retry = newBackoff(RETRY_BASE_INTERVAL, c.retryMax)
+	for tun == nil {
+		if !r.sm.transit(CLT_CONNECTING) {
+			return nil
+		}
+		var err error
+		tun, err = r.initialConnect()
+		if err != nil && isFatal(err) {
+			log.Errorf("Stop connecting to %s %s",
+				r.connInfo.RemoteName(), ex.Detail(err))
+			atomic.StoreInt32(&r.fatal, 1)
+			r.sm.fail(err)
+			return nil
+		}
+		if err != nil {
+			var delay = retry.next()
+			log.Errorf("Failed to connect to %s %s Retry after %s",
+				r.connInfo.RemoteName(), ex.Detail(err), delay)
+			r.sm.fail(err)
+			time.Sleep(delay)
 		}
-		tun = c.initialConnect()
 	}
-	atomic.StoreInt32(&c.state, CLT_WORKING)
-	rn = atomic.AddInt32(&c.round, 1)
+	return r.restarted(tun, true)
+}
+
+func (r *remote) restarted(tun *Conn, isNewSession bool) *Conn {
+	if !r.sm.transit(CLT_ONLINE) {
+		SafeClose(tun)
+		return nil
+	}
+	if isNewSession && len(r.client.reverse) > 0 {
+		// new session in server side
+		go r.requestReverse(r.getMux())
+	}
 	// start n-1 data tun
-	for j := c.params.parallels; j > 1; j-- {
-		go c.StartTun(false)
+	for j := r.params.parallels; j > 1; j-- {
+		go r.StartTun(j-1, false)
+	}
+	return tun
+}
+
+// a remaining token without waiting for new tokens
+func (r *remote) takeToken() (token []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.token) >= TKSZ {
+		token = r.token[:TKSZ]
+		r.token = r.token[TKSZ:]
 	}
 	return
 }
 
-func (c *Client) StartTun(mustRestart bool) {
+// returns nil if failed
+func (r *remote) resumeTun(token []byte) *Conn {
+	man := &d5cman{connectionInfo: r.connInfo}
+	tun, err := man.ResumeSession(r.params, token)
+	if err != nil {
+		log.Warningf("Failed to resume session of %s %s", r.connInfo.RemoteName(), ex.Detail(err))
+		return nil
+	}
+	return tun
+}
+
+// the slot is the index of parallel tuns, the restarting one is 0.
+func (r *remote) StartTun(slot int, mustRestart bool) {
 	var (
-		tun  *Conn
-		wait bool
-		rn   = atomic.LoadInt32(&c.round)
+		tun   *Conn
+		wait  time.Duration
+		rn    = r.sm.round()
+		retry = newBackoff(RETRY_BASE_INTERVAL, r.client.retryMax)
 	)
 	for {
-		if wait {
-			time.Sleep(RETRY_INTERVAL)
+		if wait > 0 {
+			time.Sleep(wait)
 		}
-		if rn < atomic.LoadInt32(&c.round) {
+		if rn < r.sm.round() {
 			return
 		}
 		if mustRestart {
 			// clear mustRestart
 			mustRestart = false
-			tun, rn = c.restart()
+			if tun = r.restart(); tun == nil {
+				return
+			}
+			rn = r.sm.round()
 		}
-		if atomic.LoadInt32(&c.state) == CLT_WORKING {
+		if r.sm.current().available() {
 			var dtcnt int32
 			var err error
 
 			// not restarting, ordinary data tun
 			if tun == nil {
-				tun, err = c.createDataTun()
+				tun, err = r.createDataTun()
 				if err != nil {
+					wait = retry.next()
 					log.Errorf("Connection failed %s Reconnect after %s",
-						ex.Detail(err), RETRY_INTERVAL)
-					wait = true
+						ex.Detail(err), wait)
 					continue
 				}
 			}
+			retry.reset()
 
 			if log.V(log.LV_CLT_CONNECT) {
 				log.Infof("Tun %s is established", tun.identifier)
 			}
 
-			dtcnt = atomic.AddInt32(&c.dtCnt, 1)
-			err = c.mux.Listen(tun, c.eventHandler, c.params.pingInterval+int(dtcnt))
-			dtcnt = atomic.AddInt32(&c.dtCnt, -1)
+			dtcnt = atomic.AddInt32(&r.dtCnt, 1)
+			if int(dtcnt) >= r.params.parallels {
+				// recovered from degraded
+				r.sm.transit(CLT_ONLINE)
+			}
+			tun.weight = r.client.weightOf(slot)
+			mux := r.getMux()
+			pings := atomic.LoadInt32(&mux.pingCnt)
+			err = mux.Listen(tun, r.eventHandler, r.params.pingInterval+int(dtcnt))
+			dtcnt = atomic.AddInt32(&r.dtCnt, -1)
 
+			wait = retry.next()
 			if log.V(log.LV_CLT_CONNECT) {
 				log.Errorf("Tun %s was disconnected %s Reconnect after %s",
-					tun.identifier, ex.Detail(err), RETRY_INTERVAL)
+					tun.identifier, ex.Detail(err), wait)
 			}
 			// reset
-			tun, wait = nil, true
+			tun = nil
 
-			// received ping count
-			if atomic.LoadInt32(&c.mux.pingCnt) <= 0 {
+			// the server pings at first on the tun of a valid token,
+			// or the tokens are invalid eg. the session was released.
+			if atomic.LoadInt32(&mux.pingCnt) == pings {
 				// dirty tokens: used abandoned tokens
-				c.clearTokens()
+				r.clearTokens()
 			}
 
 			// restart: all connections were disconnected
 			if dtcnt <= 0 {
-				if atomic.CompareAndSwapInt32(&c.state, CLT_WORKING, CLT_PENDING) {
+				if r.sm.transit(CLT_OFFLINE) {
 					log.Errorf("Currently offline, all connections %s were lost",
-						c.connInfo.RemoteName())
-					go c.StartTun(true)
+						r.connInfo.RemoteName())
+					go r.StartTun(0, true)
 				}
 				return
 			}
+			r.sm.transit(CLT_DEGRADED)
 		} else {
 			// now is restarting then exit
 			return
@@ -191,26 +414,40 @@ func (c *Client) ClientServe(conn net.Conn) {
 
 	switch proto {
 	case PROT_SOCKS5:
-		s5 := socks5Handler{pbConn}
+		s5 := socks5Handler{pbConn, c.proxyAuth}
 		if s5.handshake() {
-			if literalTarget, ok := s5.readRequest(); ok {
-				c.mux.HandleRequest("SOCKS5", conn, literalTarget)
-				done = true
+			if cmd, literalTarget, ok := s5.readRequest(); ok {
+				switch cmd {
+				case SOCKS_CMD_CONNECT:
+					c.dispatch("SOCKS5", conn, literalTarget)
+					done = true
+				case SOCKS_CMD_UDP_ASSOC:
+					if relay, ok := s5.udpAssociate(); ok {
+						c.selectMux().HandleUDPAssociate(conn, relay)
+						done = true
+					}
+				}
 			}
 		}
+	case PROT_SOCKS4:
+		s4 := socks4Handler{pbConn, c.proxyAuth}
+		if literalTarget, ok := s4.readRequest(); ok {
+			c.dispatch("SOCKS4", conn, literalTarget)
+			done = true
+		}
 	case PROT_HTTP:
-		proto, target, err := httpProxyHandshake(pbConn)
+		proto, target, err := httpProxyHandshake(pbConn, c.proxyAuth)
 		if err != nil {
 			log.Warningln(err)
 			break
 		}
 		switch proto {
 		case PROT_HTTP:
-			// plain http
-			c.mux.HandleRequest("HTTP", pbConn, target)
+			// plain http, the requests may be more than one
+			c.httpProxyServe(pbConn)
 		case PROT_HTTP_T:
 			// http tunnel
-			c.mux.HandleRequest("HTTP/T", conn, target)
+			c.dispatch("HTTP/T", conn, target)
 		case PROT_LOCAL:
 			// target is requestUri
 			c.localServlet(conn, target)
@@ -226,85 +463,120 @@ func (c *Client) ClientServe(conn net.Conn) {
 	}
 }
 
-func (t *Client) IsReady() bool {
-	return atomic.LoadInt32(&t.dtCnt) > 0
+func (c *Client) IsReady() bool {
+	for _, r := range c.remotes {
+		if r.isReady() {
+			return true
+		}
+	}
+	return false
 }
 
-func (t *Client) createDataTun() (c *Conn, err error) {
+func (r *remote) isReady() bool {
+	return atomic.LoadInt32(&r.dtCnt) > 0
+}
+
+// the tuns were established and not restarting
+func (r *remote) isHealthy() bool {
+	return r.sm.current().available() && r.isReady()
+}
+
+func (r *remote) createDataTun() (c *Conn, err error) {
 	var token []byte
-	token, err = t.getToken()
+	token, err = r.getToken()
 	if err != nil {
 		return
 	}
-	man := &d5cman{connectionInfo: t.connInfo}
-	return man.ResumeSession(t.params, token)
+	man := &d5cman{connectionInfo: r.connInfo}
+	return man.ResumeSession(r.params, token)
 }
 
-func (c *Client) eventHandler(e event, msg ...interface{}) {
+func (r *remote) eventHandler(e event, msg ...interface{}) {
 	switch e {
 	case evt_tokens:
-		go c.saveTokens(msg[0].([]byte))
+		go r.saveTokens(msg[0].([]byte))
+	case evt_reverse:
+		go r.client.reverseReply(msg[0].([]byte))
 	}
 }
 
-func (t *Client) Stats() string {
-	return fmt.Sprintf("Client -> %s Conn=%d TK=%d",
-		t.connInfo.sAddr, atomic.LoadInt32(&t.dtCnt), len(t.token)/TKSZ)
+// the weight of the parallel tun, 1 if not configured
+func (c *Client) weightOf(slot int) int {
+	if slot < len(c.weights) {
+		return c.weights[slot]
+	}
+	return 1
+}
+
+func (c *Client) Stats() string {
+	var stats = make([]string, len(c.remotes))
+	for i, r := range c.remotes {
+		stats[i] = fmt.Sprintf("Client -> %s %s Conn=%d TK=%d",
+			r.connInfo.sAddr, r.sm.current(), atomic.LoadInt32(&r.dtCnt), len(r.token)/TKSZ)
+	}
+	return strings.Join(stats, "\n")
+}
+
+func (c *Client) Close() {
+	for _, r := range c.remotes {
+		r.close()
+	}
 }
 
-func (t *Client) Close() {
-	if t.mux != nil {
-		t.mux.destroy()
+func (r *remote) close() {
+	r.sm.transit(CLT_SHUTTING_DOWN)
+	if mux := r.getMux(); mux != nil {
+		mux.destroy()
 	}
-	if t.params != nil {
-		f := t.params.cipherFactory
+	if r.params != nil {
+		f := r.params.cipherFactory
 		if f != nil {
 			f.Cleanup()
 		}
 	}
 }
 
-func (c *Client) getToken() ([]byte, error) {
-	c.lock.Lock()
+func (r *remote) getToken() ([]byte, error) {
+	r.lock.Lock()
 
-	var tlen = len(c.token) / TKSZ
+	var tlen = len(r.token) / TKSZ
 	if tlen <= TOKENS_FLOOR {
 		// TODO may request many times
-		c.asyncRequestTokens()
+		r.asyncRequestTokens()
 	}
-	for len(c.token) < TKSZ {
+	for len(r.token) < TKSZ {
 		// release lock for waiting of pendingTK()
-		c.lock.Unlock()
+		r.lock.Unlock()
 		log.Warningln("Waiting for token. Maybe the requests are coming too fast.")
-		if !c.pendingTK.await(RETRY_INTERVAL * 2) {
+		if !r.pendingTK.await(RETRY_INTERVAL * 2) {
 			// acquire() cancelled by clearAll()
 			return nil, ERR_REQ_TK_TIMEOUT
 		}
-		if atomic.LoadInt32(&c.state) < CLT_WORKING {
+		if !r.sm.current().available() {
 			return nil, ERR_REQ_TK_ABORTED
 		}
 		// recover lock status
-		c.lock.Lock()
+		r.lock.Lock()
 	}
-	var token = c.token[:TKSZ]
-	c.token = c.token[TKSZ:]
+	var token = r.token[:TKSZ]
+	r.token = r.token[TKSZ:]
 	// finally release
-	c.lock.Unlock()
+	r.lock.Unlock()
 	return token, nil
 }
 
 // async request
-func (c *Client) asyncRequestTokens() {
+func (r *remote) asyncRequestTokens() {
 	// don't require if shutdown
-	if atomic.LoadInt32(&c.state) >= CLT_WORKING {
-		go c.mux.bestSend([]byte{FRAME_ACTION_TOKEN_REQUEST}, "asyncRequestTokens")
+	if r.sm.current() != CLT_SHUTTING_DOWN {
+		go r.getMux().bestSend(FRAME_ACTION_TOKENS, []byte{FRAME_ACTION_TOKEN_REQUEST}, "asyncRequestTokens")
 		if log.V(log.LV_TOKEN) {
-			log.Infof("Request new tokens, current pool=%d\n", len(c.token)/TKSZ)
+			log.Infof("Request new tokens, current pool=%d\n", len(r.token)/TKSZ)
 		}
 	}
 }
 
-func (c *Client) saveTokens(data []byte) {
+func (r *remote) saveTokens(data []byte) {
 	var tokens []byte
 	switch data[0] {
 	case FRAME_ACTION_TOKEN_REQUEST:
@@ -313,18 +585,18 @@ func (c *Client) saveTokens(data []byte) {
 	case FRAME_ACTION_TOKEN_REPLY:
 		tokens = data[1:]
 	}
-	c.lock.Lock()
-	c.token = append(c.token, tokens...)
-	c.lock.Unlock()
+	r.lock.Lock()
+	r.token = append(r.token, tokens...)
+	r.lock.Unlock()
 	// wakeup waiting
-	c.pendingTK.notifyAll()
+	r.pendingTK.notifyAll()
 	if log.V(log.LV_TOKEN) {
-		log.Infof("Received tokens=%d pool=%d\n", len(tokens)/TKSZ, len(c.token)/TKSZ)
+		log.Infof("Received tokens=%d pool=%d\n", len(tokens)/TKSZ, len(r.token)/TKSZ)
 	}
 }
 
-func (c *Client) clearTokens() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.token = nil
+func (r *remote) clearTokens() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.token = nil
 }
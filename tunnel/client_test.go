@@ -0,0 +1,219 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// a client of the single server which is served by the mux
+func clientOf(mux *multiplexer) *Client {
+	r := &remote{sm: newStateMachine("", nil)}
+	r.setMux(mux)
+	return &Client{remotes: []*remote{r}}
+}
+
+func TestSelectRemote(t *testing.T) {
+	var c = new(Client)
+	for _, addr := range []string{"a", "b", "d"} {
+		r := c.newRemote(&connectionInfo{sAddr: addr})
+		c.remotes = append(c.remotes, r)
+	}
+	a, b, d := c.remotes[0], c.remotes[1], c.remotes[2]
+	// all offline
+	if r := c.selectRemote(); r != a {
+		t.Errorf("offline selected %s", r.connInfo.sAddr)
+	}
+	b.dtCnt, d.dtCnt = 1, 2
+	for _, r := range c.remotes {
+		r.sm.state = int32(CLT_ONLINE)
+	}
+	b.getMux().sRtt, d.getMux().sRtt = 80, 20
+
+	c.mode = SERVER_FAILOVER
+	if r := c.selectRemote(); r != b {
+		t.Errorf("failover selected %s", r.connInfo.sAddr)
+	}
+	c.mode = SERVER_LATENCY
+	if r := c.selectRemote(); r != d {
+		t.Errorf("latency selected %s", r.connInfo.sAddr)
+	}
+	c.mode = SERVER_BALANCE
+	var counter = make(map[*remote]int)
+	for i := 0; i < 10; i++ {
+		counter[c.selectRemote()]++
+	}
+	if counter[a] != 0 || counter[b] != 5 || counter[d] != 5 {
+		t.Errorf("balance selected a=%d b=%d d=%d", counter[a], counter[b], counter[d])
+	}
+	// restarting
+	d.sm.transit(CLT_OFFLINE)
+	if r := c.selectRemote(); r != b {
+		t.Errorf("balance selected %s", r.connInfo.sAddr)
+	}
+}
+
+func TestStateMachine(t *testing.T) {
+	var hub = newStateHub()
+	var events []ClientState
+	cancel := hub.subscribe(func(ev *StateEvent) {
+		events = append(events, ev.To)
+	})
+	var m = newStateMachine("a", hub)
+	if m.transit(CLT_ONLINE) {
+		t.Error("transit from offline to online")
+	}
+	for _, s := range []ClientState{CLT_CONNECTING, CLT_AUTHENTICATING,
+		CLT_ONLINE, CLT_DEGRADED, CLT_OFFLINE, CLT_SHUTTING_DOWN} {
+		if !m.transit(s) {
+			t.Errorf("transit to %s from %s was rejected", s, m.current())
+		}
+	}
+	if m.transit(CLT_CONNECTING) || m.round() != 1 {
+		t.Errorf("state=%s round=%d after shutdown", m.current(), m.round())
+	}
+	cancel()
+	m = newStateMachine("b", hub)
+	m.transit(CLT_CONNECTING)
+	if len(events) != 6 {
+		t.Errorf("received events %v", events)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	var b = newBackoff(time.Second, time.Second*10)
+	var ceil = time.Second
+	for i := 0; i < 8; i++ {
+		d := b.next()
+		if d < ceil/2 || d > ceil {
+			t.Errorf("backoff#%d=%s ceil=%s", i, d, ceil)
+		}
+		if ceil *= 2; ceil > time.Second*10 {
+			ceil = time.Second * 10
+		}
+	}
+	b.reset()
+	if d := b.next(); d > time.Second {
+		t.Errorf("backoff=%s after reset", d)
+	}
+}
+
+// the streams survive a full reconnect by resuming the session
+func TestResumeAfterAllLost(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	srv, ln := startHandshakeServer(key)
+	defer srv.Close()
+	echo, e := net.Listen("tcp", "127.0.0.1:0")
+	ThrowErr(e)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, e := echo.Accept()
+			if e != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	c := &Client{states: newStateHub(), retryMax: time.Second}
+	r := c.newRemote(&connectionInfo{
+		sAddr:   ln.Addr().String(),
+		sPubKey: srv.publicKey,
+		cipher:  srv.Cipher,
+		user:    "user",
+		pass:    "pass",
+	})
+	c.remotes = []*remote{r}
+	var online = make(chan bool, 4)
+	c.Subscribe(func(ev *StateEvent) {
+		if ev.To == CLT_ONLINE {
+			online <- true
+		}
+	})
+	c.Start()
+	defer r.sm.transit(CLT_SHUTTING_DOWN)
+	<-online
+
+	conn, e := c.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if e != nil {
+		t.Fatal("dial", e)
+	}
+	defer conn.Close()
+	var data = make([]byte, 1<<14)
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			// lose all the tuns
+			mux := r.getMux()
+			mux.pool.lock.Lock()
+			var tuns = append([]*Conn(nil), mux.pool.pool...)
+			mux.pool.lock.Unlock()
+			for _, tun := range tuns {
+				tun.Conn.Close()
+			}
+			<-online
+			if r.getMux() != mux {
+				t.Fatal("the session was not resumed")
+			}
+		}
+		randomBuffer(data)
+		go conn.Write(data)
+		var recv = make([]byte, len(data))
+		conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+		if _, e = io.ReadFull(conn, recv); e != nil || !bytes.Equal(recv, data) {
+			t.Fatalf("round %d echo error %v", i, e)
+		}
+	}
+}
+
+// the remote failed fatally won't retry, and the client is unrecoverable once all of them failed
+func TestFatalRemote(t *testing.T) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	ThrowErr(e)
+	defer ln.Close()
+	go func() {
+		// reject the dbcHello
+		for {
+			conn, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	c := &Client{states: newStateHub(), retryMax: time.Second}
+	for i := 0; i < 2; i++ {
+		c.remotes = append(c.remotes, c.newRemote(&connectionInfo{
+			sAddr:   ln.Addr().String(),
+			sPubKey: &key.PublicKey,
+		}))
+	}
+	var failed = make(chan error, 2)
+	c.Subscribe(func(ev *StateEvent) {
+		if ev.Err != nil {
+			failed <- ev.Err
+		}
+	})
+	for i, r := range c.remotes {
+		if tun := r.restart(); tun != nil {
+			t.Fatalf("remote %d restarted", i)
+		}
+		if e = <-failed; !isFatal(e) {
+			t.Errorf("remote %d failed with %v", i, e)
+		}
+		if s := r.sm.current(); s != CLT_OFFLINE {
+			t.Errorf("remote %d is %s", i, s)
+		}
+		if c.Unrecoverable() != (i == 1) {
+			t.Errorf("unrecoverable=%v after %d failed", c.Unrecoverable(), i+1)
+		}
+	}
+}
@@ -190,9 +190,15 @@ func SafeClose(conn net.Conn) {
 	}
 }
 
+// the connections supporting half-close, eg. *net.TCPConn
+type halfCloser interface {
+	CloseRead() error
+	CloseWrite() error
+}
+
 func closeR(conn net.Conn) {
 	defer func() { _ = recover() }()
-	if t, y := conn.(*net.TCPConn); y {
+	if t, y := conn.(halfCloser); y {
 		t.CloseRead()
 	} else {
 		conn.Close()
@@ -201,7 +207,7 @@ func closeR(conn net.Conn) {
 
 func closeW(conn net.Conn) {
 	defer func() { _ = recover() }()
-	if t, y := conn.(*net.TCPConn); y {
+	if t, y := conn.(halfCloser); y {
 		t.CloseWrite()
 	} else {
 		conn.Close()
@@ -238,6 +244,17 @@ func IsClosedError(err error) bool {
 	return strings.Contains(msg, "closed") || strings.Contains(msg, "reset")
 }
 
+// the delay before retrying to accept after temporary errors
+// eg. too many open files
+func acceptDelay(delay time.Duration) time.Duration {
+	if delay *= 2; delay == 0 {
+		delay = time.Millisecond * 5
+	} else if delay > time.Second {
+		delay = time.Second
+	}
+	return delay
+}
+
 func setRTimeout(conn net.Conn) {
 	e := conn.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
 	ThrowErr(e)
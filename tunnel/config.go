@@ -16,6 +16,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Lafeng/deblocus/auth"
 	"github.com/Lafeng/deblocus/crypto"
@@ -34,6 +35,11 @@ const (
 	CF_CREDENTIAL = "Credential"
 	CF_PAC        = "PAC.Server"
 	CF_FILE       = "File"
+	CF_AUTO       = "Auto"
+	CF_FORWARD    = "Forward"
+	CF_REVERSE    = "Reverse"
+	CF_REV_PORTS  = "ReversePorts"
+	CF_EGRESS     = "Egress"
 
 	CONFIG_NAME = "deblocus.ini"
 	SIZE_UNIT   = "BKMG"
@@ -160,6 +166,29 @@ func (cman *ConfigMan) ListenAddr(expectedRole ServerRole) *net.TCPAddr {
 	return nil
 }
 
+// listen address of transparent proxy, nil if disabled
+func (cman *ConfigMan) TransparentAddr() *net.TCPAddr {
+	if cman.cConf != nil {
+		return cman.cConf.TransparentAddr
+	}
+	return nil
+}
+
+// listen address of local dns, nil if disabled
+func (cman *ConfigMan) DNSAddr() *net.TCPAddr {
+	if cman.cConf != nil {
+		return cman.cConf.DNSAddr
+	}
+	return nil
+}
+
+func (cman *ConfigMan) LocalForwards() []*LocalForward {
+	if cman.cConf != nil {
+		return cman.cConf.forwards
+	}
+	return nil
+}
+
 func (cman *ConfigMan) KeyInfo(expectedRole ServerRole) string {
 	var buf = new(bytes.Buffer)
 	if expectedRole&SR_SERVER != 0 {
@@ -169,24 +198,48 @@ func (cman *ConfigMan) KeyInfo(expectedRole ServerRole) string {
 		fmt.Fprintln(buf, "  fingerprint:", FingerprintOfKey(key))
 	}
 	if expectedRole&SR_CLIENT != 0 {
-		key := cman.cConf.connInfo.sPubKey
-		fmt.Fprintln(buf, "Credential Key in", cman.filepath)
-		fmt.Fprintln(buf, "         type:", NameOfKey(key))
-		fmt.Fprintln(buf, "  fingerprint:", FingerprintOfKey(key))
+		for _, info := range cman.cConf.connInfos {
+			key := info.sPubKey
+			fmt.Fprintln(buf, "Credential Key of", info.RemoteName(), "in", cman.filepath)
+			fmt.Fprintln(buf, "         type:", NameOfKey(key))
+			fmt.Fprintln(buf, "  fingerprint:", FingerprintOfKey(key))
+		}
 	}
 	return buf.String()
 }
 
 // client config definitions
 type clientConf struct {
-	Listen     string       `importable:":9009"`
-	Verbose    int          `importable:"1"`
-	ListenAddr *net.TCPAddr `ini:"-"`
-	connInfo   *connectionInfo
+	Listen          string       `importable:":9009"`
+	Verbose         int          `importable:"1"`
+	ProxyAuth       string       `ini:",omitempty"`
+	Transparent     string       `ini:",omitempty"`
+	Rules           string       `ini:",omitempty"`
+	DNS             string       `ini:",omitempty"`
+	Selection       string       `ini:",omitempty"`
+	Weights         string       `ini:",omitempty"`
+	ServerMode      string       `ini:",omitempty"`
+	RetryMax        string       `ini:",omitempty"`
+	RekeyBytes      int64        `ini:",omitempty"`
+	RekeyInterval   string       `ini:",omitempty"`
+	ListenAddr      *net.TCPAddr `ini:"-"`
+	TransparentAddr *net.TCPAddr `ini:"-"`
+	DNSAddr         *net.TCPAddr `ini:"-"`
+	proxyAuth       auth.AuthSys
+	rules           *RuleSet
+	selection       SelectionStrategy
+	weights         []int
+	forwards        []*LocalForward
+	reverse         []*ReverseForward
+	connInfos       []*connectionInfo // in order of preference
+	retryMax        time.Duration
+	rekey           rekeyLimit
+	pacFile         string
+	pacAuto         bool
 }
 
 func (c *clientConf) validate() error {
-	if c.connInfo == nil {
+	if len(c.connInfos) == 0 {
 		return CONF_MISS.Apply("Not found credential")
 	}
 	if c.Listen == NULL {
@@ -196,12 +249,106 @@ func (c *clientConf) validate() error {
 	if e != nil {
 		return LOCAL_BIND_ERROR.Apply(e)
 	}
-	pkType := NameOfKey(c.connInfo.sPubKey)
-	if pkType != c.connInfo.pkType {
-		return CONF_ERROR.Apply(pkType)
+	for _, info := range c.connInfos {
+		pkType := NameOfKey(info.sPubKey)
+		if pkType != info.pkType {
+			return CONF_ERROR.Apply(pkType)
+		}
+	}
+	// selection of servers
+	switch strings.ToLower(c.ServerMode) {
+	case NULL, strings.ToLower(SERVER_FAILOVER):
+		c.ServerMode = SERVER_FAILOVER
+	case strings.ToLower(SERVER_LATENCY):
+		c.ServerMode = SERVER_LATENCY
+	case strings.ToLower(SERVER_BALANCE):
+		c.ServerMode = SERVER_BALANCE
+	default:
+		return CONF_ERROR.Apply("ServerMode " + c.ServerMode)
+	}
+	// cap of reconnecting interval, e.g. 5m
+	if c.RetryMax == NULL {
+		c.retryMax = RETRY_MAX_INTERVAL
+	} else {
+		c.retryMax, e = time.ParseDuration(c.RetryMax)
+		if e != nil || c.retryMax < RETRY_BASE_INTERVAL {
+			return CONF_ERROR.Apply("RetryMax " + c.RetryMax)
+		}
+	}
+	// rekey the tuns after the bytes or the interval, eg. 1073741824 and 1h
+	c.rekey, e = parseRekeyLimit(c.RekeyBytes, c.RekeyInterval)
+	if e != nil {
+		return e
+	}
+	if c.pacFile != NULL && IsNotExist(c.pacFile) {
+		return CONF_ERROR.Apply("File Not Found " + c.pacFile)
+	}
+	if c.pacFile != NULL && c.pacAuto {
+		return CONF_ERROR.Apply("PAC File conflicts with Auto")
+	}
+	// authentication of local proxy
+	if c.ProxyAuth != NULL {
+		c.proxyAuth, e = auth.GetAuthSysImpl(c.ProxyAuth)
+		if e != nil {
+			return e
+		}
+	}
+	// routing rules
+	if c.Rules != NULL {
+		c.rules, e = LoadRuleSet(c.Rules)
+		if e != nil {
+			return CONF_ERROR.Apply(e)
+		}
+	}
+	// tun selection: Priority, LeastActive, LowestRtt, RoundRobin
+	c.selection, e = NewSelectionStrategy(c.Selection)
+	if e != nil {
+		return CONF_ERROR.Apply(e)
+	}
+	// weights of the parallel tuns for RoundRobin, eg. 3,1
+	if c.Weights != NULL {
+		for _, w := range strings.Split(c.Weights, ",") {
+			n, e := strconv.Atoi(strings.TrimSpace(w))
+			if e != nil || n <= 0 {
+				return CONF_ERROR.Apply("Weights " + c.Weights)
+			}
+			c.weights = append(c.weights, n)
+		}
+	}
+	// transparent proxy listener
+	if c.Transparent != NULL {
+		if runtime.GOOS != "linux" {
+			return CONF_ERROR.Apply("Transparent is supported on linux only")
+		}
+		c.TransparentAddr, e = net.ResolveTCPAddr("tcp", c.Transparent)
+		if e != nil {
+			return LOCAL_BIND_ERROR.Apply(e)
+		}
+	}
+	// local dns listener for both udp and tcp
+	if c.DNS != NULL {
+		c.DNSAddr, e = net.ResolveTCPAddr("tcp", c.DNS)
+		if e != nil {
+			return LOCAL_BIND_ERROR.Apply(e)
+		}
+	}
+	// listeners must not conflict
+	var bound = map[string]bool{a.String(): true}
+	var listeners []*net.TCPAddr
+	if c.TransparentAddr != nil {
+		listeners = append(listeners, c.TransparentAddr)
+	}
+	if c.DNSAddr != nil {
+		listeners = append(listeners, c.DNSAddr)
 	}
-	if c.connInfo.pacFile != NULL && IsNotExist(c.connInfo.pacFile) {
-		return CONF_ERROR.Apply("File Not Found " + c.connInfo.pacFile)
+	for _, f := range c.forwards {
+		listeners = append(listeners, f.ListenAddr)
+	}
+	for _, addr := range listeners {
+		if bound[addr.String()] {
+			return LOCAL_BIND_ERROR.Apply("Duplicated " + addr.String())
+		}
+		bound[addr.String()] = true
 	}
 	c.ListenAddr = a
 	return nil
@@ -214,7 +361,6 @@ type connectionInfo struct {
 	user     string
 	pass     string
 	pkType   string
-	pacFile  string
 	sPubKey  stdcrypto.PublicKey
 	rawURL   string
 }
@@ -331,39 +477,77 @@ func (cman *ConfigMan) ParseClientConf() (conf *clientConf, err error) {
 	if err != nil {
 		return
 	}
-	cr, err := ii.GetSection(CF_CREDENTIAL)
-	if err != nil {
-		return
+	// Forward, Forward.xx = listen -> target
+	// Reverse, Reverse.xx = server listen -> target
+	for _, k := range secDc.Keys() {
+		switch name := k.Name(); {
+		case strings.HasPrefix(name, CF_FORWARD):
+			var fwd *LocalForward
+			fwd, err = parseLocalForward(k.String())
+			if err != nil {
+				return
+			}
+			conf.forwards = append(conf.forwards, fwd)
+		case strings.HasPrefix(name, CF_REVERSE):
+			var rev *ReverseForward
+			rev, err = parseReverseForward(k.String())
+			if err != nil {
+				return
+			}
+			conf.reverse = append(conf.reverse, rev)
+		}
+	}
+	// Credential, Credential.xx for each server in order
+	for _, sec := range ii.Sections() {
+		if name := sec.Name(); name == CF_CREDENTIAL || strings.HasPrefix(name, CF_CREDENTIAL+".") {
+			var connInfo *connectionInfo
+			connInfo, err = parseCredential(sec)
+			if err != nil {
+				return
+			}
+			conf.connInfos = append(conf.connInfos, connInfo)
+		}
 	}
+	secPac, _ := ii.GetSection(CF_PAC)
+	if secPac != nil && secPac.Haskey(CF_FILE) {
+		pacFile, _ := secPac.GetKey(CF_FILE)
+		conf.pacFile = pacFile.String()
+	}
+	// generate pac from rules
+	if secPac != nil && secPac.Haskey(CF_AUTO) {
+		conf.pacAuto, err = secPac.Key(CF_AUTO).Bool()
+		if err != nil {
+			err = CONF_ERROR.Apply(CF_AUTO)
+			return
+		}
+	}
+	err = conf.validate()
+	return
+}
+
+func parseCredential(cr *ini.Section) (*connectionInfo, error) {
 	url, err := cr.GetKey(CF_URL)
 	if err != nil {
-		return
+		return nil, err
 	}
 	connInfo, err := newConnectionInfo(url.String())
 	if err != nil {
-		return
+		return nil, err
 	}
 	pubkeyObj, err := cr.GetKey(CF_KEY)
 	if err != nil {
-		return
+		return nil, err
 	}
 	pubkeyBytes, err := base64.StdEncoding.DecodeString(pubkeyObj.String())
 	if err != nil {
-		return
+		return nil, err
 	}
 	pubkey, err := UnmarshalPublicKey(pubkeyBytes)
 	if err != nil {
-		return
-	}
-	secPac, _ := ii.GetSection(CF_PAC)
-	if secPac != nil && secPac.Haskey(CF_FILE) {
-		pacFile, _ := secPac.GetKey(CF_FILE)
-		connInfo.pacFile = pacFile.String()
+		return nil, err
 	}
 	connInfo.sPubKey = pubkey
-	conf.connInfo = connInfo
-	err = conf.validate()
-	return
+	return connInfo, nil
 }
 
 // Server config definitions
@@ -376,11 +560,24 @@ type serverConf struct {
 	Verbose       int          `importable:"1"`
 	DenyDest      string       `importable:"OFF"`
 	ErrorFeedback string       `importable:"true"`
+	Resolver      string       `ini:",omitempty"`
+	Egress        string       `ini:",omitempty"`
+	PreferFamily  string       `ini:",omitempty"`
+	FallbackDelay string       `ini:",omitempty"`
+	DHMethods     string       `ini:",omitempty"`
+	RekeyBytes    int64        `ini:",omitempty"`
+	RekeyInterval string       `ini:",omitempty"`
 	AuthSys       auth.AuthSys `ini:"-"`
 	ListenAddr    *net.TCPAddr `ini:"-"`
 	errFeedback   bool
+	fallbackDelay time.Duration
+	dhMethods     []string // allowed in order of preference
+	rekey         rekeyLimit
 	privateKey    stdcrypto.PrivateKey
 	publicKey     stdcrypto.PublicKey
+	reversePorts  map[string]portRanges // user -> permitted ports
+	dialer        Dialer
+	egress        map[string]Dialer // user -> dialer
 }
 
 func (d *serverConf) validate() error {
@@ -422,15 +619,63 @@ func (d *serverConf) validate() error {
 			return CONF_ERROR.Apply("DenyDest must be ISO3166-1 2-letter Country Code")
 		}
 	}
+	// upstream nameserver for the tunneled dns
+	if d.Resolver != NULL {
+		if _, _, e = net.SplitHostPort(d.Resolver); e != nil {
+			d.Resolver = net.JoinHostPort(d.Resolver, "53")
+		}
+		if _, e = net.ResolveUDPAddr("udp", d.Resolver); e != nil {
+			return CONF_ERROR.Apply("Resolver")
+		}
+	}
 	if len(d.ErrorFeedback) > 0 {
 		d.errFeedback, e = strconv.ParseBool(d.ErrorFeedback)
 		if e != nil {
 			return CONF_ERROR.Apply("ErrorFeedback")
 		}
 	}
+	// key exchange methods, eg. X25519,ECC-P256
+	if d.DHMethods != NULL {
+		for _, m := range strings.Split(d.DHMethods, DH_METHODS_SEP) {
+			m = strings.ToUpper(strings.TrimSpace(m))
+			if chooseDHMethod(DH_METHODS, []string{m}) == NULL {
+				return CONF_ERROR.Apply("DHMethods " + m)
+			}
+			d.dhMethods = append(d.dhMethods, m)
+		}
+	}
+	// rekey the tuns after the bytes or the interval, eg. 1073741824 and 1h
+	d.rekey, e = parseRekeyLimit(d.RekeyBytes, d.RekeyInterval)
+	if e != nil {
+		return e
+	}
+	// dual-stack destinations: the preferred family and the delay before falling back
+	switch d.PreferFamily = strings.ToLower(d.PreferFamily); d.PreferFamily {
+	case NULL:
+		d.PreferFamily = FAMILY_IPV6
+	case FAMILY_IPV4, FAMILY_IPV6:
+	default:
+		return CONF_ERROR.Apply("PreferFamily must be ipv4 or ipv6")
+	}
+	d.fallbackDelay = HAPPY_FALLBACK_DELAY
+	if d.FallbackDelay != NULL {
+		d.fallbackDelay, e = time.ParseDuration(d.FallbackDelay)
+		if e != nil || d.fallbackDelay <= 0 {
+			return CONF_ERROR.Apply("FallbackDelay")
+		}
+	}
+	// outbound: direct, bind://ip, socks5://host:port, http://host:port
+	d.dialer, e = d.newDialer(d.Egress)
+	if e != nil {
+		return CONF_ERROR.Apply(e)
+	}
 	return nil
 }
 
+func (d *serverConf) newDialer(egress string) (Dialer, error) {
+	return newDialer(egress, d.PreferFamily, d.fallbackDelay)
+}
+
 // public for external handler
 func (cman *ConfigMan) ParseServConf() (d5s *serverConf, err error) {
 	ii := cman.iniInstance
@@ -460,7 +705,29 @@ func (cman *ConfigMan) ParseServConf() (d5s *serverConf, err error) {
 	}
 	d5s.privateKey = priv
 	d5s.publicKey = priv.(stdcrypto.Signer).Public()
-	err = d5s.validate()
+	// optional: user = ports permitted for reverse forwarding
+	if rSec, _ := ii.GetSection(CF_REV_PORTS); rSec != nil {
+		d5s.reversePorts = make(map[string]portRanges)
+		for _, k := range rSec.Keys() {
+			d5s.reversePorts[k.Name()], err = parsePortRanges(k.String())
+			if err != nil {
+				return
+			}
+		}
+	}
+	if err = d5s.validate(); err != nil {
+		return
+	}
+	// optional: user = egress of the user
+	if eSec, _ := ii.GetSection(CF_EGRESS); eSec != nil {
+		d5s.egress = make(map[string]Dialer)
+		for _, k := range eSec.Keys() {
+			d5s.egress[k.Name()], err = d5s.newDialer(k.String())
+			if err != nil {
+				return
+			}
+		}
+	}
 	return
 }
 
@@ -606,6 +873,8 @@ const _CLT_CONF_HEADER = `
 const _COMMENTED_PAC_SECTION = `# Optional
 # [PAC.Server]
 # File = mypac.js
+# or generate it from the Rules
+# Auto = true
 `
 
 const _NOTICE_MOD_ADDR = `
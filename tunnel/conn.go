@@ -3,6 +3,7 @@ package tunnel
 import (
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,10 +12,15 @@ import (
 type Conn struct {
 	net.Conn
 	cipher     cipherKit
+	rekey      *rekeyer
 	closed     int32
 	identifier string
 	wlock      *sync.Mutex
 	priority   *TSPriority
+	streams    int32 // active streams
+	sRtt       int32 // smoothed rtt in ms
+	weight     int   // weight of round-robin, see Client.weightOf
+	current    int   // current weight of round-robin
 }
 
 func NewConn(conn net.Conn, cipher cipherKit) *Conn {
@@ -26,37 +32,45 @@ func NewConn(conn net.Conn, cipher cipherKit) *Conn {
 }
 
 func (c *Conn) SetId(name string, isServ bool) {
-	ra := c.RemoteAddr().(*net.TCPAddr)
-	la := c.LocalAddr().(*net.TCPAddr)
+	ra, la := c.RemoteAddr(), c.LocalAddr()
 	if isServ {
 		// unique in server instance
 		// fmt: user@full_addr
 		c.identifier = fmt.Sprintf("%s@%s", name, ra.String())
 	} else {
 		// for client
-		c.identifier = fmt.Sprintf("%d:%d", la.Port, ra.Port)
+		c.identifier = fmt.Sprintf("%s:%s", addrPort(la), addrPort(ra))
 	}
 }
 
-func (c *Conn) SetupCipher(cf *CipherFactory, iv []byte) {
+// port of tcp address, or the entire address of other networks
+func addrPort(addr net.Addr) string {
+	if a, y := addr.(*net.TCPAddr); y {
+		return strconv.Itoa(a.Port)
+	}
+	return addr.String()
+}
+
+func (c *Conn) SetupCipher(cf *CipherFactory, iv []byte, isServ bool) {
 	c.wlock.Lock()
 	defer c.wlock.Unlock()
-	c.cipher = cf.InitCipher(iv)
+	kit := cf.InitCipher(iv, isServ)
+	c.cipher = &duplexCipherKit{kit, kit}
+	c.rekey = newRekeyer(cf, isServ)
 }
 
 func (c *Conn) Read(b []byte) (int, error) {
-	n, err := c.Conn.Read(b)
-	if n > 0 {
-		c.cipher.decrypt(b[:n], b[:n])
-	}
-	return n, err
+	return c.cipher.read(c.Conn, b)
 }
 
-func (c *Conn) Write(b []byte) (int, error) {
+func (c *Conn) Write(b []byte) (n int, err error) {
 	c.wlock.Lock()
 	defer c.wlock.Unlock()
-	c.cipher.encrypt(b, b)
-	return c.Conn.Write(b)
+	n, err = c.cipher.write(c.Conn, b)
+	if err == nil && c.rekey != nil && c.rekey.due(n) {
+		err = c.rekeyWrite()
+	}
+	return
 }
 
 func (c *Conn) isClosed() bool {
@@ -69,14 +83,14 @@ func (c *Conn) Close() error {
 }
 
 func (c *Conn) CloseRead() {
-	if conn, ok := c.Conn.(*net.TCPConn); ok {
+	if conn, ok := c.Conn.(halfCloser); ok {
 		atomic.AddInt32(&c.closed, 1)
 		conn.CloseRead()
 	}
 }
 
 func (c *Conn) CloseWrite() {
-	if conn, ok := c.Conn.(*net.TCPConn); ok {
+	if conn, ok := c.Conn.(halfCloser); ok {
 		conn.CloseWrite()
 	}
 }
@@ -122,6 +136,9 @@ func cleanupConn(c *Conn) {
 		c.cipher.Cleanup()
 		c.cipher = nil
 	}
+	if c != nil && c.rekey != nil {
+		c.rekey.cleanup()
+	}
 }
 
 //
@@ -1,10 +1,11 @@
 package tunnel
 
 import (
-	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 
+	ex "github.com/Lafeng/deblocus/exception"
 	log "github.com/Lafeng/deblocus/glog"
 )
 
@@ -15,13 +16,28 @@ type TSPriority struct {
 	rank int64
 }
 
+const (
+	SELECT_PRIORITY     = "Priority"
+	SELECT_LEAST_ACTIVE = "LeastActive"
+	SELECT_LOWEST_RTT   = "LowestRtt"
+	SELECT_ROUND_ROBIN  = "RoundRobin"
+)
+
+var (
+	UNKNOWN_SELECTION = ex.New("Unknown selection strategy")
+)
+
 type ConnPool struct {
-	pool sortableConns
-	lock sync.Locker
+	pool     sortableConns
+	lock     sync.Locker
+	strategy SelectionStrategy
 }
 
 func NewConnPool() *ConnPool {
-	return &ConnPool{lock: new(sync.Mutex)}
+	return &ConnPool{
+		lock:     new(sync.Mutex),
+		strategy: priorityStrategy{},
+	}
 }
 
 type sortableConns []*Conn
@@ -70,18 +86,26 @@ func (h *ConnPool) Len() int {
 	return h.pool.Len()
 }
 
+// nil for the default strategy
+func (h *ConnPool) SetStrategy(s SelectionStrategy) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if s == nil {
+		s = priorityStrategy{}
+	}
+	h.strategy = s
+}
+
 func (h *ConnPool) Select() *Conn {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 	if h.pool.Len() < 1 {
 		return nil
 	}
-	sort.Sort(h.pool)
+	selected := h.strategy.Select(h.pool)
 	if log.V(log.LV_TUN_SELECT) {
-		log.Infoln("Selected tun", h.pool[0].LocalAddr())
+		log.Infoln("Selected tun", selected.LocalAddr())
 	}
-	selected := h.pool[0]
-	atomic.AddInt64(&selected.priority.rank, SELECT_DECREASE)
 	return selected
 }
 
@@ -93,3 +117,104 @@ func (h *ConnPool) destroy() {
 	}
 	h.pool = nil
 }
+
+// ------------------------------
+// SelectionStrategy
+// ------------------------------
+type SelectionStrategy interface {
+	// choose one from the non-empty pool
+	// it's called with the lock of pool.
+	Select(pool []*Conn) *Conn
+}
+
+// empty name for the default strategy
+func NewSelectionStrategy(name string) (SelectionStrategy, error) {
+	switch strings.ToLower(name) {
+	case NULL, strings.ToLower(SELECT_PRIORITY):
+		return priorityStrategy{}, nil
+	case strings.ToLower(SELECT_LEAST_ACTIVE):
+		return leastActiveStrategy{}, nil
+	case strings.ToLower(SELECT_LOWEST_RTT):
+		return lowestRttStrategy{}, nil
+	case strings.ToLower(SELECT_ROUND_ROBIN):
+		return roundRobinStrategy{}, nil
+	}
+	return nil, UNKNOWN_SELECTION.Apply(name)
+}
+
+// the highest rank which was derived from read timing, see Conn.Update
+// and the rank of selected one will be decreased.
+type priorityStrategy struct{}
+
+func (priorityStrategy) Select(pool []*Conn) *Conn {
+	selected := pool[0]
+	rank := atomic.LoadInt64(&selected.priority.rank)
+	for _, c := range pool[1:] {
+		if r := atomic.LoadInt64(&c.priority.rank); r > rank {
+			selected, rank = c, r
+		}
+	}
+	atomic.AddInt64(&selected.priority.rank, SELECT_DECREASE)
+	return selected
+}
+
+// the least active streams
+type leastActiveStrategy struct{}
+
+func (leastActiveStrategy) Select(pool []*Conn) *Conn {
+	selected := pool[0]
+	streams := atomic.LoadInt32(&selected.streams)
+	for _, c := range pool[1:] {
+		if n := atomic.LoadInt32(&c.streams); n < streams {
+			selected, streams = c, n
+		}
+	}
+	return selected
+}
+
+// the lowest smoothed rtt, the unmeasured ones are the last choices
+// then the least active streams in the same rtt.
+type lowestRttStrategy struct{}
+
+func (lowestRttStrategy) Select(pool []*Conn) *Conn {
+	var (
+		selected *Conn
+		rtt      int32
+		streams  int32
+	)
+	for _, c := range pool {
+		r := atomic.LoadInt32(&c.sRtt)
+		if r <= 0 {
+			r = 1<<31 - 1
+		}
+		n := atomic.LoadInt32(&c.streams)
+		if selected == nil || r < rtt || (r == rtt && n < streams) {
+			selected, rtt, streams = c, r, n
+		}
+	}
+	return selected
+}
+
+// smooth weighted round-robin
+// each one gains its weight, and the selected one loses the total.
+type roundRobinStrategy struct{}
+
+func (roundRobinStrategy) Select(pool []*Conn) *Conn {
+	var (
+		selected *Conn
+		total    int
+	)
+	for _, c := range pool {
+		w := c.weight
+		if w <= 0 {
+			w = 1
+		}
+		c.current += w
+		total += w
+		if selected == nil || c.current > selected.current {
+			selected = c
+		}
+	}
+	selected.current -= total
+	return selected
+}
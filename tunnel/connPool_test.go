@@ -58,3 +58,45 @@ func randn(m int) int {
 	}
 	return n
 }
+
+func Test_strategies(t *testing.T) {
+	var conns = make([]*Conn, 3)
+	for i := range conns {
+		conns[i] = NewConn(nil, nil)
+		conns[i].priority = &TSPriority{1, 1e9}
+	}
+	p := NewConnPool()
+	for _, c := range conns {
+		p.Push(c)
+	}
+
+	s, _ := NewSelectionStrategy("leastactive")
+	p.SetStrategy(s)
+	conns[0].streams, conns[1].streams, conns[2].streams = 3, 1, 2
+	if c := p.Select(); c != conns[1] {
+		t.Errorf("least active selected streams=%d", c.streams)
+	}
+
+	s, _ = NewSelectionStrategy(SELECT_LOWEST_RTT)
+	p.SetStrategy(s)
+	conns[0].sRtt, conns[1].sRtt, conns[2].sRtt = 30, 0, 20
+	if c := p.Select(); c != conns[2] {
+		t.Errorf("lowest rtt selected rtt=%d", c.sRtt)
+	}
+
+	s, _ = NewSelectionStrategy(SELECT_ROUND_ROBIN)
+	p.SetStrategy(s)
+	conns[0].weight, conns[1].weight, conns[2].weight = 3, 1, 0
+	var counter = make(map[*Conn]int)
+	for i := 0; i < 50; i++ {
+		counter[p.Select()]++
+	}
+	if counter[conns[0]] != 30 || counter[conns[1]] != 10 || counter[conns[2]] != 10 {
+		t.Errorf("round-robin selected %d %d %d",
+			counter[conns[0]], counter[conns[1]], counter[conns[2]])
+	}
+
+	if _, e := NewSelectionStrategy("Random"); e == nil {
+		t.Error("unknown strategy was accepted")
+	}
+}
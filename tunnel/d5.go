@@ -7,11 +7,9 @@ import (
 	"io"
 	"math/rand"
 	"net"
-	"os"
 	"strings"
 	"time"
 
-	"github.com/Lafeng/deblocus/auth"
 	"github.com/Lafeng/deblocus/crypto"
 	"github.com/Lafeng/deblocus/exception"
 	log "github.com/Lafeng/deblocus/glog"
@@ -38,7 +36,9 @@ const (
 )
 
 const (
-	EFB_CODE_PRE_AUTH byte = 1
+	EFB_CODE_PRE_AUTH  byte = 1
+	EFB_CODE_DH_METHOD byte = 2
+	EFB_CODE_VERSION   byte = 3
 )
 
 const (
@@ -55,15 +55,23 @@ var (
 
 var (
 	// D5 exceptions
-	ILLEGAL_STATE        = exception.New("Invalid State")
-	VALIDATION_FAILED    = exception.New("Validation Failed")
-	INCONSISTENT_HASH    = exception.New("Inconsistent Hashsum")
-	INCOMPATIBLE_VERSION = exception.New("Incompatible Version")
-	UNRECOGNIZED_REQ     = exception.New("Unrecognized Request")
-	ERR_PRE_AUTH_UNKNOWN = exception.New("Pre-auth failed")
-	ERR_PRE_AUTH         = exception.New(EMSG_PRE_AUTH)
-	ERR_HIDDEN_EFB       = exception.New(EMSG_HIDDEN_EFB)
-	ABORTED_ERROR        = exception.New("")
+	ILLEGAL_STATE     = exception.New("Invalid State")
+	VALIDATION_FAILED = exception.New("Validation Failed")
+	INCONSISTENT_HASH = exception.New("Inconsistent Hashsum")
+	UNRECOGNIZED_REQ  = exception.New("Unrecognized Request")
+	ERR_PRE_AUTH      = ErrPreAuth.Apply(EMSG_PRE_AUTH)
+	ERR_HIDDEN_EFB    = ErrPreAuth.Apply(EMSG_HIDDEN_EFB)
+	ERR_DH_METHOD     = ErrIncompatibleVersion.Apply("No acceptable DH method")
+	ERR_REFUSED_VER   = ErrIncompatibleVersion.Apply("Refused by the remote")
+	ABORTED_ERROR     = exception.New("")
+)
+
+var (
+	// the client couldn't recover from them by retrying.
+	// the errors returned by handshake could be checked with errors.Is
+	ErrPreAuth             = exception.New("Pre-auth failed")
+	ErrIncompatibleVersion = exception.New("Incompatible Version")
+	ErrAuthFailed          = exception.New("Auth failed")
 )
 
 // len_inByte enum: 1,2,4
@@ -112,23 +120,29 @@ func (p *tunParams) deserialize(buf []byte) {
 
 func compareVersion(buf []byte) error {
 	// compare version with remote
+	if len(buf) != 4 {
+		return ErrIncompatibleVersion.Apply("unknown")
+	}
 	myVer := VERSION
 	rVer := binary.BigEndian.Uint32(buf)
+	rVerStr := fmt.Sprintf("%d.%d.%04d", rVer>>24, (rVer>>16)&0xFF, rVer&0xFFFF)
+	// the protocol is changed along with major.minor
+	if myVer>>16 != rVer>>16 {
+		return ErrIncompatibleVersion.Apply(rVerStr)
+	}
 	if rVer > myVer {
-		rVerStr := fmt.Sprintf("%d.%d.%04d", rVer>>24, (rVer>>16)&0xFF, rVer&0xFFFF)
-		myVer >>= 16
-		rVer >>= 16
-		if myVer == rVer {
-			log.Warningf("Caution !!! Please upgrade to new version, remote is v%s\n", rVerStr)
-		} else {
-			return INCOMPATIBLE_VERSION.Apply(rVerStr)
-		}
+		log.Warningf("Caution !!! Please upgrade to new version, remote is v%s\n", rVerStr)
 	}
 	return nil
 }
 
+// the key exchange methods in order of preference,
+// only the key of the first is offered and the others are generated on demand.
+var DH_METHODS = []string{"X25519", "ECC-P256", "ECC-P384", "ECC-P521", "DHE"}
+
 const (
-	DH_METHOD = "ECC-P256"
+	DH_METHODS_MAX = 8
+	DH_METHODS_SEP = ","
 )
 
 //
@@ -137,43 +151,29 @@ const (
 type d5cman struct {
 	*connectionInfo
 	dhKey    crypto.DHKE
+	dhMethod string
+	methods  []byte
 	dbcHello []byte
 	sRand    []byte
+	// called when the raw connection was established before handshake
+	connected func()
 }
 
 func (n *d5cman) Connect(p *tunParams) (conn *Conn, err error) {
 	var rawConn net.Conn
 	defer func() {
-		n.dbcHello, n.sRand = nil, nil
+		n.dbcHello, n.sRand, n.dhKey = nil, nil, nil
 		if exception.Catch(recover(), &err) {
 			SafeClose(rawConn)
-			if t, y := err.(*exception.Exception); y {
-				if t.Origin != nil {
-					t = t.Origin
-				}
-				var exitCode int
-				// must terminate
-				switch t {
-				case ERR_PRE_AUTH, ERR_PRE_AUTH_UNKNOWN, ERR_HIDDEN_EFB:
-					exitCode = 2
-				case INCOMPATIBLE_VERSION:
-					exitCode = 3
-				}
-				if exitCode > 0 {
-					line := string(bytes.Repeat([]byte{'+'}, 30))
-					log.Warningln(line)
-					log.Warningln(err)
-					log.Warningln(line)
-					os.Exit(exitCode)
-				}
-			}
 		}
 	}()
 	rawConn, err = net.DialTimeout("tcp", n.sAddr, GENERAL_SO_TIMEOUT)
-	n.dhKey, _ = crypto.NewDHKey(DH_METHOD)
 	if err != nil {
 		return
 	}
+	if n.connected != nil {
+		n.connected()
+	}
 
 	conn = NewConn(rawConn, nullCipherKit)
 	if err = n.requestDHExchange(conn); err != nil {
@@ -192,6 +192,9 @@ func (n *d5cman) Connect(p *tunParams) (conn *Conn, err error) {
 	}
 	p.cipherFactory = cf
 	conn.SetId(n.provider, false)
+	if log.V(log.LV_CLT_CONNECT) {
+		log.Infof("Tun %s was established by %s/%s", conn.identifier, n.dhMethod, n.cipher)
+	}
 	return
 }
 
@@ -214,13 +217,13 @@ func (n *d5cman) ResumeSession(p *tunParams, token []byte) (conn *Conn, err erro
 		return
 	}
 
-	conn.SetupCipher(p.cipherFactory, token)
+	conn.SetupCipher(p.cipherFactory, token, false)
 	conn.SetId(n.provider, false)
 	return conn, nil
 }
 
-// 1-send dbcHello,dhPub
-// dbcHello~256 | dhPubLen~2 | dhPub~?
+// 1-send dbcHello,version,methods,dhPub of the first method
+// dbcHello~256 | verLen~1 | ver~4 | methodsLen~1 | methods~? | dhPubLen~2 | dhPub~?
 func (n *d5cman) requestDHExchange(conn *Conn) (err error) {
 	// obfuscated header
 	obf := makeDbcHello(TYPE_NEW, preSharedKey(n.sPubKey))
@@ -231,9 +234,22 @@ func (n *d5cman) requestDHExchange(conn *Conn) (err error) {
 		n.dbcHello = obf
 	}
 
-	// dhke
-	pub := n.dhKey.ExportPubKey()
-	w.WriteL2Msg(pub)
+	// the server rejects the incompatible before dhke
+	w.WriteL1Msg(ito4b(VERSION))
+
+	// dhke: offer the supported methods with the public key of the preferred
+	n.methods = []byte(strings.Join(DH_METHODS, DH_METHODS_SEP))
+	w.WriteL1Msg(n.methods)
+	return n.offerDHKey(conn, w, DH_METHODS[0])
+}
+
+// generate the key of method and send the public key
+func (n *d5cman) offerDHKey(conn *Conn, w *msgWriter, method string) (err error) {
+	n.dhMethod = method
+	if n.dhKey, err = crypto.NewDHKey(method); err != nil {
+		return
+	}
+	w.WriteL2Msg(n.dhKey.ExportPubKey())
 
 	setWTimeout(conn)
 	err = w.WriteTo(conn)
@@ -241,22 +257,24 @@ func (n *d5cman) requestDHExchange(conn *Conn) (err error) {
 	return
 }
 
-// read dhPub from server and verify sign
-// dhPubLen~1 | dhPub~? | signLen~1 | sign~? | rand
-func (n *d5cman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
-	var dhk, dhkSign []byte
-	// recv: rhPub~2+256 or ecdhPub~2+32
+// read the chosen method and dhPub, the dhPub is empty if the server
+// chose the other method than the offered key.
+func (n *d5cman) readDHChoice(conn *Conn) (method, dhk []byte, err error) {
 	setRTimeout(conn)
-	dhk, err = ReadFullByLen(1, conn)
+	method, err = ReadFullByLen(1, conn)
 	if err != nil {
-		if len(dhk) > 0 { // can recv error feedback
-			code, rt := parseErrorFeedback(dhk)
+		if len(method) > 0 { // can recv error feedback
+			code, rt := parseErrorFeedback(method)
 			rTime := rt.Format(time.StampMilli)
 			switch code {
 			case EFB_CODE_PRE_AUTH:
 				err = ERR_PRE_AUTH.Apply("Remote Time " + rTime)
+			case EFB_CODE_DH_METHOD:
+				err = ERR_DH_METHOD
+			case EFB_CODE_VERSION:
+				err = ERR_REFUSED_VER
 			default:
-				err = ERR_PRE_AUTH_UNKNOWN.Apply("Remote Time " + rTime)
+				err = ErrPreAuth.Apply("Remote Time " + rTime)
 			}
 
 		} else { // no error feedback OR network error occurred actually
@@ -269,6 +287,40 @@ func (n *d5cman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
 		return
 	}
 
+	// recv: dhPub~2+256 or ecdhPub~2+32
+	setRTimeout(conn)
+	dhk, err = ReadFullByLen(2, conn)
+	if err != nil {
+		exception.Spawn(&err, "dh: read response")
+	}
+	return
+}
+
+// read the chosen method and dhPub from server and verify sign
+// methodLen~1 | method~? | dhPubLen~2 | dhPub~? | signLen~1 | sign~? | rand
+// or methodLen~1 | method~? | 0~2 if asked for the key of method, then reply
+// dhPubLen~2 | dhPub~? and read the above.
+func (n *d5cman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
+	var method, dhk, dhkSign []byte
+	if method, dhk, err = n.readDHChoice(conn); err != nil {
+		return
+	}
+	if len(dhk) == 0 && string(method) != n.dhMethod {
+		// only the offered methods are acceptable
+		if chooseDHMethod(DH_METHODS, []string{string(method)}) == NULL {
+			return nil, ERR_DH_METHOD.Apply(string(method))
+		}
+		if err = n.offerDHKey(conn, newMsgWriter(), string(method)); err != nil {
+			return
+		}
+		if method, dhk, err = n.readDHChoice(conn); err != nil {
+			return
+		}
+	}
+	if string(method) != n.dhMethod || len(dhk) == 0 {
+		return nil, ERR_DH_METHOD.Apply(string(method))
+	}
+
 	setRTimeout(conn)
 	dhkSign, err = ReadFullByLen(1, conn)
 	if err != nil {
@@ -276,7 +328,8 @@ func (n *d5cman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
 		return
 	}
 
-	if !DSAVerify(n.sPubKey, dhkSign, dhk) {
+	// the offered and chosen methods are signed to prevent downgrade
+	if !DSAVerify(n.sPubKey, dhkSign, signedDHMessage(n.methods, method, dhk)) {
 		// MITM ?
 		return nil, VALIDATION_FAILED
 	}
@@ -295,7 +348,7 @@ func (n *d5cman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
 
 	// setup cipher
 	cf = NewCipherFactory(n.cipher, key, n.dbcHello)
-	conn.SetupCipher(cf, n.sRand)
+	conn.SetupCipher(cf, n.sRand, false)
 	return
 }
 
@@ -350,7 +403,7 @@ func (n *d5cman) authThenFinishSetting(conn *Conn, t *tunParams) error {
 	switch buf[0] {
 	case AUTH_PASS:
 	default:
-		return auth.AUTH_FAILED
+		return ErrAuthFailed
 	}
 
 	// parse params
@@ -399,6 +452,11 @@ func (n *d5sman) Connect(conn *Conn, tcPool []uint64) (session *Session, err err
 
 		nr = 0 // reset nr
 		ok, stype, len2 := verifyDbcHello(buf, n.sharedKey, tcPool)
+		// the replayed hello is regarded as unrecognized
+		if ok && n.replay.seen(binary.BigEndian.Uint64(buf[DPH_LEN1:DPH_P2])) {
+			ok = false
+			log.Warningf("Replayed hello from=%s", n.clientAddr)
+		}
 
 		if ok {
 			if len2 > 0 {
@@ -464,7 +522,7 @@ func (n *d5sman) resumeSession(conn *Conn) (session *Session, err error) {
 		// check token ok
 		if session := n.sessionMgr.take(token); session != nil {
 			// reuse cipherFactory to init cipher
-			conn.SetupCipher(session.cipherFactory, token)
+			conn.SetupCipher(session.cipherFactory, token, true)
 			// identify connection
 			conn.SetId(session.uid, true)
 			return session, nil
@@ -475,24 +533,74 @@ func (n *d5sman) resumeSession(conn *Conn) (session *Session, err error) {
 }
 
 // finish DHE
-// 1, dhPub, dhSign, rand
+// 0, method, empty if the key of the other method is required, then read dhPub
+// 1, method, dhPub, dhSign, rand
 // 2, hashHello, version
 func (n *d5sman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
-	var dhPub, key []byte
-	dhKey, _ := crypto.NewDHKey(DH_METHOD)
+	var ver, methods, dhPub, key []byte
+	setRTimeout(conn)
+	ver, err = ReadFullByLen(1, conn)
+	if err != nil {
+		exception.Spawn(&err, "ver: read connection")
+		return
+	}
+	if err = compareVersion(ver); err != nil {
+		if n.errFeedback {
+			sendErrorFeedback(conn, EFB_CODE_VERSION)
+		}
+		return
+	}
 
 	setRTimeout(conn)
-	dhPub, err = ReadFullByLen(2, conn)
+	methods, err = ReadFullByLen(1, conn)
 	if err != nil {
 		exception.Spawn(&err, "dh: read connection")
 		return
 	}
+	offered := strings.Split(string(methods), DH_METHODS_SEP)
+	if len(offered) > DH_METHODS_MAX {
+		return nil, VALIDATION_FAILED
+	}
+	setRTimeout(conn)
+	if dhPub, err = ReadFullByLen(2, conn); err != nil {
+		exception.Spawn(&err, "dh: read connection")
+		return
+	}
+
+	method := chooseDHMethod(n.dhMethods, offered)
+	if method == NULL {
+		if n.errFeedback {
+			sendErrorFeedback(conn, EFB_CODE_DH_METHOD)
+		}
+		return nil, ERR_DH_METHOD.Apply(string(methods))
+	}
+	dhKey, err := crypto.NewDHKey(method)
+	if err != nil {
+		return
+	}
 
 	w := newMsgWriter()
+	// the offered key is the first method
+	if method != offered[0] {
+		w.WriteL1Msg([]byte(method))
+		w.WriteL2Msg(nil)
+		setWTimeout(conn)
+		if err = w.WriteTo(conn); err != nil {
+			exception.Spawn(&err, "dh: write connection")
+			return
+		}
+		setRTimeout(conn)
+		if dhPub, err = ReadFullByLen(2, conn); err != nil {
+			exception.Spawn(&err, "dh: read connection")
+			return
+		}
+	}
+
+	w.WriteL1Msg([]byte(method))
 	myDhPub := dhKey.ExportPubKey()
-	w.WriteL1Msg(myDhPub)
+	w.WriteL2Msg(myDhPub)
 
-	myDhSign := DSASign(n.privateKey, myDhPub)
+	myDhSign := DSASign(n.privateKey, signedDHMessage(methods, []byte(method), myDhPub))
 	w.WriteL1Msg(myDhSign)
 
 	n.sRand = randMinArray()
@@ -513,7 +621,7 @@ func (n *d5sman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
 
 	// setup cipher
 	cf = NewCipherFactory(n.Cipher, key, n.dbcHello)
-	conn.SetupCipher(cf, n.sRand)
+	conn.SetupCipher(cf, n.sRand, true)
 
 	// encrypted
 	w.WriteL1Msg(hash256(n.dbcHello))
@@ -573,6 +681,8 @@ func (n *d5sman) authenticate(conn *Conn, session *Session) error {
 	}
 
 	session.indentifySession(user, conn)
+	session.reversePorts = n.reversePorts[user]
+	session.mux.dialer = n.dialerOf(user)
 	w := newMsgWriter()
 	w.WriteL1Msg([]byte{AUTH_PASS})
 	w.WriteL2Msg(n.tunParams.serialize())
@@ -604,6 +714,29 @@ func (n *d5sman) deserializeIdentity(block []byte) (user, pass string, e error)
 	return
 }
 
+// the first allowed method offered by client, all methods are allowed if nil
+func chooseDHMethod(allowed, offered []string) string {
+	if allowed == nil {
+		allowed = DH_METHODS
+	}
+	for _, m := range allowed {
+		for _, o := range offered {
+			if m == o {
+				return m
+			}
+		}
+	}
+	return NULL
+}
+
+// offered methods | chosen method | dhPub
+func signedDHMessage(methods, method, dhPub []byte) []byte {
+	msg := make([]byte, 0, len(methods)+len(method)+len(dhPub)+2)
+	msg = append(append(msg, methods...), 0)
+	msg = append(append(msg, method...), 0)
+	return append(msg, dhPub...)
+}
+
 func parseErrorFeedback(buf []byte) (code byte, rt time.Time) {
 	if len(buf) == 0xff && buf[0] == 0xee {
 		code = buf[1]
@@ -611,7 +744,7 @@ func parseErrorFeedback(buf []byte) (code byte, rt time.Time) {
 			return
 		}
 	}
-	panic(ERR_PRE_AUTH_UNKNOWN)
+	panic(ErrPreAuth)
 }
 
 func sendErrorFeedback(conn net.Conn, code byte) {
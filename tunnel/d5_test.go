@@ -1,8 +1,14 @@
 package tunnel
 
 import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	"math/rand"
+	"net"
 	"testing"
 	"time"
 
@@ -116,3 +122,178 @@ func (t *test) Skip(args ...interface{})                  {}
 func (t *test) SkipNow()                                  {}
 func (t *test) Skipf(format string, args ...interface{})  {}
 func (t *test) Skipped() bool                             { return t.TB.Skipped() }
+
+// the fatal errors are returned rather than terminating the process
+func TestHandshakeFatalError(tt *testing.T) {
+	t := newTest(tt)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Assert(err == nil).Fatal(err)
+	defer ln.Close()
+	go func() {
+		// reset the connection like a server which rejects the dbcHello
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	man := &d5cman{connectionInfo: &connectionInfo{
+		sAddr:   ln.Addr().String(),
+		sPubKey: &key.PublicKey,
+	}}
+	_, err = man.Connect(new(tunParams))
+	t.Assert(errors.Is(err, ErrPreAuth)).Fatalf("expected ErrPreAuth but %v", err)
+
+	var buf = make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, VERSION+1<<24)
+	err = compareVersion(buf)
+	t.Assert(errors.Is(err, ErrIncompatibleVersion)).Fatalf("expected ErrIncompatibleVersion but %v", err)
+}
+
+func TestCompareVersion(tt *testing.T) {
+	t := newTest(tt)
+	defer func(v uint32) { VERSION = v }(VERSION)
+	VERSION = 0x000e0100
+	var buf = make([]byte, 4)
+	for rVer, compatible := range map[uint32]bool{
+		0x000e0100: true,
+		0x000e0200: true, // newer build
+		0x000e0001: true,
+		0x000d0100: false, // older protocol
+		0x000f0100: false,
+	} {
+		binary.BigEndian.PutUint32(buf, rVer)
+		err := compareVersion(buf)
+		t.Assert((err == nil) == compatible).Fatalf("remote %x error %v", rVer, err)
+	}
+}
+
+// a server over tcp to handshake with
+func startHandshakeServer(priv stdcrypto.PrivateKey) (*Server, net.Listener) {
+	srv := newTestServer()
+	srv.privateKey = priv
+	srv.publicKey = priv.(stdcrypto.Signer).Public()
+	srv.sharedKey = preSharedKey(srv.publicKey)
+	srv.Cipher, srv.AuthSys, srv.errFeedback = "AES128GCM", testAuthSys{"user": "pass"}, true
+	srv.tunParams = &tunParams{pingInterval: DT_PING_INTERVAL, parallels: 1}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	ThrowErr(err)
+	go srv.Serve(ln)
+	return srv, ln
+}
+
+func handshake(srv *Server, ln net.Listener) (*d5cman, error) {
+	man := &d5cman{connectionInfo: &connectionInfo{
+		sAddr:   ln.Addr().String(),
+		sPubKey: srv.publicKey,
+		cipher:  srv.Cipher,
+		user:    "user",
+		pass:    "pass",
+	}}
+	conn, err := man.Connect(new(tunParams))
+	if conn != nil {
+		conn.Close()
+	}
+	return man, err
+}
+
+func TestDHNegotiation(tt *testing.T) {
+	t := newTest(tt)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	srv, ln := startHandshakeServer(key)
+	defer srv.Close()
+
+	// the server chooses by its preference, and asks for the key of it
+	srv.dhMethods = []string{"ECC-P384", "X25519"}
+	man, err := handshake(srv, ln)
+	t.Assert(err == nil && man.dhMethod == "ECC-P384").Fatalf("negotiated %s error %v", man.dhMethod, err)
+	srv.dhMethods = nil
+	man, err = handshake(srv, ln)
+	t.Assert(err == nil && man.dhMethod == DH_METHODS[0]).Fatalf("negotiated %s error %v", man.dhMethod, err)
+
+	// incompatible clients: another protocol version, or the older without it
+	for _, hello := range [][]byte{
+		append([]byte{4}, ito4b(VERSION+1<<16)...),
+		append([]byte{0, 32}, randArray(32)...),
+	} {
+		raw, err := net.Dial("tcp", ln.Addr().String())
+		t.Assert(err == nil).Fatal(err)
+		raw.Write(append(makeDbcHello(TYPE_NEW, srv.sharedKey), hello...))
+		_, _, err = new(d5cman).readDHChoice(NewConn(raw, nullCipherKit))
+		raw.Close()
+		t.Assert(errors.Is(err, ErrIncompatibleVersion)).Fatalf("expected ErrIncompatibleVersion but %v", err)
+	}
+
+	// no common method
+	defer func(methods []string) { DH_METHODS = methods }(DH_METHODS)
+	DH_METHODS = []string{"X25519"}
+	srv.dhMethods = []string{"DHE"}
+	_, err = handshake(srv, ln)
+	t.Assert(errors.Is(err, ErrIncompatibleVersion)).Fatalf("expected ErrIncompatibleVersion but %v", err)
+}
+
+func TestEd25519Key(tt *testing.T) {
+	t := newTest(tt)
+	priv, err := GenerateDSAKey("ed25519")
+	t.Assert(err == nil).Fatal(err)
+	// config: marshal and unmarshal
+	priv, err = UnmarshalPrivateKey(MarshalPrivateKey(priv))
+	t.Assert(err == nil).Fatal("unmarshal private key", err)
+	pubBytes, err := MarshalPublicKey(priv.(stdcrypto.Signer).Public())
+	t.Assert(err == nil).Fatal("marshal public key", err)
+	pub, err := UnmarshalPublicKey(pubBytes)
+	t.Assert(err == nil).Fatal("unmarshal public key", err)
+	// keyinfo
+	t.Assert(NameOfKey(pub) == "ED25519").Fatal("name of key", NameOfKey(pub))
+	t.Assert(len(FingerprintOfKey(pub)) == 47).Fatal("fingerprint", FingerprintOfKey(pub))
+	// signing
+	msg := randArray(65)
+	sig := DSASign(priv, msg)
+	t.Assert(DSAVerify(pub, sig, msg)).Fatal("verify")
+	msg[0]++
+	t.Assert(!DSAVerify(pub, sig, msg)).Fatal("verified the modified")
+
+	srv, ln := startHandshakeServer(priv)
+	defer srv.Close()
+	_, err = handshake(srv, ln)
+	t.Assert(err == nil).Fatal("handshake", err)
+}
+
+func TestReplayedHello(tt *testing.T) {
+	t := newTest(tt)
+	srv := newTestServer()
+	hello := makeDbcHello(TYPE_RES, srv.sharedKey)
+	resume := func(hello []byte) error {
+		c, s := net.Pipe()
+		defer c.Close()
+		go c.Write(append(append([]byte(nil), hello...), randArray(TKSZ)...))
+		man := &d5sman{Server: srv, clientAddr: c.LocalAddr()}
+		_, err := man.Connect(NewConn(s, nullCipherKit), calculateTimeCounter(true))
+		return err
+	}
+	// the first is recognized but has an unknown token
+	err := resume(hello)
+	t.Assert(err == VALIDATION_FAILED).Fatalf("expected validation failed but %v", err)
+	err = resume(hello)
+	t.Assert(err == UNRECOGNIZED_REQ).Fatalf("expected unrecognized but %v", err)
+	t.Assert(srv.replay.replayed() == 1).Fatalf("replayed %d", srv.replay.replayed())
+
+	// expired with the time counters
+	for i := 0; i < REPLAY_GENERATIONS; i++ {
+		t.Assert(srv.replay.seen(1) == (i > 0)).Fatalf("generation %d", i)
+		srv.replay.rotate()
+	}
+	t.Assert(!srv.replay.seen(1)).Fatalf("expected expired")
+
+	// the oldest are dropped if filled up
+	filter := newReplayFilter()
+	filter.limit = 4
+	for i := uint64(0); i <= 4*REPLAY_GENERATIONS; i++ {
+		filter.seen(i)
+	}
+	t.Assert(!filter.seen(0) && filter.seen(4*REPLAY_GENERATIONS)).Fatalf("expected bounded")
+}
@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"time"
+
+	ex "github.com/Lafeng/deblocus/exception"
+)
+
+var (
+	ERR_OPEN_FAILED = ex.New("Remote open failed")
+	ERR_OPEN_DENIED = ex.New("Request was denied by remote")
+)
+
+// Dial connects to the address via the tunnel, see DialContext.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext opens a stream to the address via the tunnel without
+// a local proxy. The network must be "tcp", "tcp4" or "tcp6".
+// It returns after the server has connected to the address, and the
+// returned connection supports deadlines and half-close.
+// The rules of client are not applied.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	if err := IsValidHost(addr); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	local, remote := newStreamPipe(addr)
+	var opened = make(chan error, 1)
+	go c.selectMux().openStream("API", remote, addr, opened)
+
+	var err error
+	select {
+	case err = <-opened:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		local.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: streamAddr(addr), Err: err}
+	}
+	return local, nil
+}
+
+// address of the stream
+type streamAddr string
+
+func (a streamAddr) Network() string {
+	return "deblocus"
+}
+
+func (a streamAddr) String() string {
+	return string(a)
+}
+
+// one end of the stream, composed of two synchronous pipes in both
+// directions, so either one could be closed alone.
+type streamConn struct {
+	r      net.Conn // read from peer
+	w      net.Conn // write to peer
+	local  net.Addr
+	remote net.Addr
+}
+
+// returns the end for the caller and the end for the edge of multiplexer
+func newStreamPipe(target string) (local, edge *streamConn) {
+	inR, inW := net.Pipe()
+	outR, outW := net.Pipe()
+	local = &streamConn{
+		r:      inR,
+		w:      outW,
+		local:  streamAddr("api"),
+		remote: streamAddr(target),
+	}
+	edge = &streamConn{
+		r:      outR,
+		w:      inW,
+		local:  local.remote,
+		remote: local.local,
+	}
+	return
+}
+
+func (s *streamConn) Read(b []byte) (int, error) {
+	return s.r.Read(b)
+}
+
+func (s *streamConn) Write(b []byte) (int, error) {
+	return s.w.Write(b)
+}
+
+func (s *streamConn) Close() error {
+	er := s.r.Close()
+	ew := s.w.Close()
+	if er != nil {
+		return er
+	}
+	return ew
+}
+
+// peer will be unable to write
+func (s *streamConn) CloseRead() error {
+	return s.r.Close()
+}
+
+// peer will read EOF
+func (s *streamConn) CloseWrite() error {
+	return s.w.Close()
+}
+
+func (s *streamConn) LocalAddr() net.Addr {
+	return s.local
+}
+
+func (s *streamConn) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *streamConn) SetDeadline(t time.Time) error {
+	er := s.r.SetReadDeadline(t)
+	ew := s.w.SetWriteDeadline(t)
+	if er != nil {
+		return er
+	}
+	return ew
+}
+
+func (s *streamConn) SetReadDeadline(t time.Time) error {
+	return s.r.SetReadDeadline(t)
+}
+
+func (s *streamConn) SetWriteDeadline(t time.Time) error {
+	return s.w.SetWriteDeadline(t)
+}
@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDialContext(t *testing.T) {
+	startEmulation()
+	c := clientOf(client)
+
+	// http.Transport
+	svr := startHttpSvr("A")
+	defer svr.Close()
+	tr := &http.Transport{DialContext: c.DialContext}
+	hc := &http.Client{Transport: tr}
+	resp, e := hc.Get("http://" + svr.Addr().String() + "/dial")
+	if e != nil {
+		t.Fatal("http via DialContext", e)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	tr.CloseIdleConnections()
+	if !strings.HasPrefix(string(body), "A|/dial|") {
+		t.Errorf("response is %s", body)
+	}
+
+	// half-close: reply all the received after EOF
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	ThrowErr(e)
+	defer ln.Close()
+	go func() {
+		conn, e := ln.Accept()
+		if e != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		conn.Write(data)
+	}()
+	conn, e := c.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if e != nil {
+		t.Fatal("dial", e)
+	}
+	defer conn.Close()
+	var data = make([]byte, 1<<16)
+	randomBuffer(data)
+	go func() {
+		conn.Write(data)
+		conn.(halfCloser).CloseWrite()
+	}()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if echo, e := ioutil.ReadAll(conn); e != nil || !bytes.Equal(echo, data) {
+		t.Errorf("half-closed echo len=%d error=%v", len(echo), e)
+	}
+
+	// deadline
+	idle, e := c.Dial("tcp", svr.Addr().String())
+	if e != nil {
+		t.Fatal("dial", e)
+	}
+	idle.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, e = idle.Read(data); !IsTimeout(e) {
+		t.Errorf("expected timeout but %v", e)
+	}
+	idle.Close()
+
+	// refused
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	if _, e = c.Dial("tcp", closed.Addr().String()); !errors.Is(e, ERR_OPEN_FAILED) {
+		t.Errorf("expected ERR_OPEN_FAILED but %v", e)
+	}
+	if _, e = c.Dial("udp", svr.Addr().String()); e == nil {
+		t.Error("dial udp")
+	}
+	rest(3)
+	checkFinishedLength(t)
+}
@@ -0,0 +1,435 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	ex "github.com/Lafeng/deblocus/exception"
+)
+
+// the kinds of egress
+const (
+	EGRESS_DIRECT = "direct" // direct://
+	EGRESS_BIND   = "bind"   // bind://source_ip or bind://interface
+	EGRESS_SOCKS5 = "socks5" // socks5://[user:pass@]host:port
+	EGRESS_HTTP   = "http"   // http://[user:pass@]host:port
+)
+
+const (
+	DIAL_DEST_TIMEOUT = time.Second * 3
+)
+
+var (
+	INVALID_EGRESS = ex.New("Invalid egress")
+	UPSTREAM_ERROR = ex.New("Upstream proxy error")
+)
+
+// Dialer connects to the destinations requested by clients.
+// *net.Dialer is a Dialer.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// NewDialer creates a dialer by the egress url, the empty means direct.
+// The direct connections prefer ipv6 and fall back to ipv4 as RFC 8305.
+func NewDialer(egress string) (Dialer, error) {
+	return newDialer(egress, FAMILY_IPV6, HAPPY_FALLBACK_DELAY)
+}
+
+func newDialer(egress, prefer string, fallbackDelay time.Duration) (Dialer, error) {
+	var direct = newHappyDialer(prefer, fallbackDelay)
+	if egress == NULL {
+		return direct, nil
+	}
+	u, err := url.Parse(egress)
+	if err != nil {
+		return nil, INVALID_EGRESS.Apply(err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case EGRESS_DIRECT:
+		return direct, nil
+
+	case EGRESS_BIND:
+		var ip = net.ParseIP(u.Hostname())
+		if ip == nil {
+			if ip, err = interfaceAddr(u.Hostname()); err != nil {
+				return nil, INVALID_EGRESS.Apply(err)
+			}
+		}
+		direct.LocalAddr = &net.TCPAddr{IP: ip}
+		return direct, nil
+
+	case EGRESS_SOCKS5, EGRESS_HTTP:
+		if _, _, err = net.SplitHostPort(u.Host); err != nil {
+			return nil, INVALID_EGRESS.Apply(err)
+		}
+		var p = &upstreamDialer{
+			scheme:  strings.ToLower(u.Scheme),
+			proxy:   u.Host,
+			forward: direct,
+		}
+		if u.User != nil {
+			p.user = u.User.Username()
+			p.passwd, _ = u.User.Password()
+		}
+		return p, nil
+	}
+	return nil, INVALID_EGRESS.Apply(egress)
+}
+
+// the local address of udp associations following the egress of dialer
+// returns false if the dialer couldn't relay udp, eg. the proxy chain.
+func udpLocalAddr(d Dialer) (*net.UDPAddr, bool) {
+	var local net.Addr
+	switch d := d.(type) {
+	case nil:
+		return nil, true
+	case *happyDialer:
+		local = d.LocalAddr
+	case *net.Dialer:
+		local = d.LocalAddr
+	default:
+		return nil, false
+	}
+	if a, y := local.(*net.TCPAddr); y && a != nil {
+		return &net.UDPAddr{IP: a.IP}, true
+	}
+	return nil, true
+}
+
+// the first ip of the interface, prefer ipv4
+func interfaceAddr(name string) (ip net.IP, err error) {
+	var iface *net.Interface
+	var addrs []net.Addr
+	if iface, err = net.InterfaceByName(name); err != nil {
+		return
+	}
+	if addrs, err = iface.Addrs(); err != nil {
+		return
+	}
+	for _, a := range addrs {
+		if n, y := a.(*net.IPNet); y {
+			if n.IP.To4() != nil {
+				return n.IP, nil
+			} else if ip == nil {
+				ip = n.IP
+			}
+		}
+	}
+	if ip == nil {
+		err = fmt.Errorf("no address on %s", name)
+	}
+	return
+}
+
+// connect via an upstream socks5 or http proxy
+type upstreamDialer struct {
+	scheme  string
+	proxy   string
+	user    string
+	passwd  string
+	forward Dialer
+}
+
+func (d *upstreamDialer) Dial(network, addr string) (conn net.Conn, err error) {
+	conn, err = d.forward.Dial(network, d.proxy)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+	if d.scheme == EGRESS_SOCKS5 {
+		err = d.socks5Connect(conn, addr)
+	} else {
+		conn, err = d.httpConnect(conn, addr)
+	}
+	if err != nil {
+		SafeClose(conn)
+		return nil, err
+	}
+	conn.SetDeadline(ZERO_TIME)
+	return
+}
+
+// Ref: https://www.ietf.org/rfc/rfc1928.txt
+func (d *upstreamDialer) socks5Connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+	var buf = make([]byte, 0, 262) // 4+(1+255)+2
+	// methods
+	if d.user == NULL {
+		buf = append(buf, S5_VER, 1, SOCKS_AUTH_NONE)
+	} else {
+		buf = append(buf, S5_VER, 2, SOCKS_AUTH_NONE, SOCKS_AUTH_PASSWD)
+	}
+	if _, err = conn.Write(buf); err != nil {
+		return err
+	}
+	buf = buf[:2]
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	switch {
+	case buf[0] != S5_VER:
+		return UPSTREAM_ERROR.Apply("socks version")
+	case buf[1] == SOCKS_AUTH_PASSWD && d.user != NULL:
+		// Ref: https://www.ietf.org/rfc/rfc1929.txt
+		buf = append(buf[:0], SOCKS_AUTH_PASS_VER, byte(len(d.user)))
+		buf = append(buf, d.user...)
+		buf = append(buf, byte(len(d.passwd)))
+		buf = append(buf, d.passwd...)
+		if _, err = conn.Write(buf); err != nil {
+			return err
+		}
+		buf = buf[:2]
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return UPSTREAM_ERROR.Apply("socks authentication failed")
+		}
+	case buf[1] != SOCKS_AUTH_NONE:
+		return UPSTREAM_ERROR.Apply("socks authentication required")
+	}
+
+	// request
+	buf = append(buf[:0], S5_VER, SOCKS_CMD_CONNECT, 0)
+	if ip := net.ParseIP(host); ip == nil {
+		buf = append(buf, DOMAIN, byte(len(host)))
+		buf = append(buf, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, IPV4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, IPV6)
+		buf = append(buf, ip...)
+	}
+	buf = append(buf, 0, 0)
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(port))
+	if _, err = conn.Write(buf); err != nil {
+		return err
+	}
+
+	// reply: ver, rep, rsv, atyp, addr, port
+	buf = buf[:5]
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		return UPSTREAM_ERROR.Apply(fmt.Sprintf("socks reply %d", buf[1]))
+	}
+	var remains int
+	switch buf[3] {
+	case IPV4:
+		remains = net.IPv4len - 1
+	case IPV6:
+		remains = net.IPv6len - 1
+	case DOMAIN:
+		remains = int(buf[4])
+	default:
+		return UPSTREAM_ERROR.Apply("socks address type")
+	}
+	_, err = io.ReadFull(conn, buf[:remains+2])
+	return err
+}
+
+func (d *upstreamDialer) httpConnect(conn net.Conn, addr string) (net.Conn, error) {
+	var req = "CONNECT " + addr + " HTTP/1.1" + CRLF + "Host: " + addr + CRLF
+	if d.user != NULL {
+		cred := base64.StdEncoding.EncodeToString([]byte(d.user + ":" + d.passwd))
+		req += "Proxy-Authorization: Basic " + cred + CRLF
+	}
+	if _, err := io.WriteString(conn, req+CRLF); err != nil {
+		return conn, err
+	}
+	var reader = bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return conn, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return conn, UPSTREAM_ERROR.Apply(resp.Status)
+	}
+	// the data following response
+	if n := reader.Buffered(); n > 0 {
+		pbConn := NewPushbackInputStream(conn)
+		remains, _ := reader.Peek(n)
+		pbConn.Unread(remains)
+		return pbConn, nil
+	}
+	return conn, nil
+}
+
+// the address families
+const (
+	FAMILY_IPV4 = "ipv4"
+	FAMILY_IPV6 = "ipv6"
+)
+
+// Connection Attempt Delay, Ref: RFC 8305 section 5
+const HAPPY_FALLBACK_DELAY = time.Millisecond * 250
+
+var ERR_NO_ADDRESS = ex.New("No suitable address")
+
+// Happy Eyeballs, Ref: https://tools.ietf.org/html/rfc8305
+// the addresses of both families are interleaved starting with the preferred,
+// and the next attempt is started after FallbackDelay or the previous failed.
+type happyDialer struct {
+	net.Dialer
+	prefer string
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newHappyDialer(prefer string, fallbackDelay time.Duration) *happyDialer {
+	d := &happyDialer{
+		prefer: prefer,
+		lookup: net.DefaultResolver.LookupIPAddr,
+	}
+	d.Timeout = DIAL_DEST_TIMEOUT
+	d.FallbackDelay = fallbackDelay
+	return d
+}
+
+func (d *happyDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *happyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = d.sortAddrs(network, ips)
+	if len(ips) == 0 {
+		return nil, ERR_NO_ADDRESS.Apply(addr)
+	}
+	return d.race(ctx, ips, port)
+}
+
+// interleave the families starting with the preferred,
+// and drop the addresses could not be used by network or LocalAddr.
+func (d *happyDialer) sortAddrs(network string, ips []net.IPAddr) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if network == "tcp6" {
+		v4 = nil
+	} else if network == "tcp4" {
+		v6 = nil
+	}
+	if d.LocalAddr != nil {
+		if isIPv4(d.LocalAddr) {
+			v6 = nil
+		} else {
+			v4 = nil
+		}
+	}
+	primary, fallback := v6, v4
+	if d.prefer == FAMILY_IPV4 {
+		primary, fallback = v4, v6
+	}
+	var sorted = make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(primary) || i < len(fallback); i++ {
+		if i < len(primary) {
+			sorted = append(sorted, primary[i])
+		}
+		if i < len(fallback) {
+			sorted = append(sorted, fallback[i])
+		}
+	}
+	return sorted
+}
+
+func (d *happyDialer) race(ctx context.Context, ips []net.IPAddr, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var delay = d.FallbackDelay
+	if delay <= 0 {
+		delay = HAPPY_FALLBACK_DELAY
+	}
+	var results = make(chan dialResult, len(ips))
+	var fallback <-chan time.Time
+	var next, pending int
+	var firstErr error
+	for {
+		if next < len(ips) {
+			go func(addr string) {
+				conn, err := d.Dialer.DialContext(ctx, "tcp", addr)
+				results <- dialResult{conn, err}
+			}(net.JoinHostPort(ips[next].String(), port))
+			next++
+			pending++
+			fallback = time.After(delay)
+		} else {
+			fallback = nil
+		}
+
+		select {
+		case <-fallback:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the late winners
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if pending == 0 && next == len(ips) {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// the family of the ip address, or empty for the others
+func addrFamily(addr net.Addr) string {
+	if a, y := addr.(*net.TCPAddr); y {
+		if a.IP.To4() != nil {
+			return FAMILY_IPV4
+		}
+		return FAMILY_IPV6
+	}
+	return NULL
+}
@@ -0,0 +1,207 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// a socks5 and http proxy for testing upstream
+func startUpstreamProxy(authSys testAuthSys) net.Listener {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	ThrowErr(e)
+	go func() {
+		for {
+			conn, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				var target string
+				pbConn := NewPushbackInputStream(conn)
+				if proto, _ := detectProtocol(pbConn); proto == PROT_SOCKS5 {
+					s5 := socks5Handler{pbConn, authSys}
+					if !s5.handshake() {
+						return
+					}
+					if _, target, _ = s5.readRequest(); target == NULL {
+						return
+					}
+				} else if _, target, e = httpProxyHandshake(pbConn, authSys); e != nil {
+					return
+				}
+				dst, e := net.Dial("tcp", target)
+				if e != nil {
+					return
+				}
+				defer dst.Close()
+				go io.Copy(dst, pbConn)
+				io.Copy(conn, dst)
+			}(conn)
+		}
+	}()
+	return ln
+}
+
+func startEchoSvr() net.Listener {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	ThrowErr(e)
+	go func() {
+		for {
+			conn, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestNewDialer(t *testing.T) {
+	for _, egress := range []string{"", "direct://", "bind://127.0.0.1",
+		"socks5://127.0.0.1:1080", "HTTP://u:p@[::1]:3128"} {
+		if _, e := NewDialer(egress); e != nil {
+			t.Errorf("egress %s error %v", egress, e)
+		}
+	}
+	for _, egress := range []string{"ftp://127.0.0.1:21", "socks5://127.0.0.1",
+		"bind://not-an-interface"} {
+		if _, e := NewDialer(egress); e == nil {
+			t.Errorf("egress %s was accepted", egress)
+		}
+	}
+	for egress, local := range map[string]string{
+		"bind://127.0.0.1": "127.0.0.1:0",
+		"bind://[::1]":     "[::1]:0",
+	} {
+		d, _ := NewDialer(egress)
+		if addr := d.(*happyDialer).LocalAddr; addr == nil || addr.String() != local {
+			t.Errorf("%s bind to %s", egress, addr)
+		}
+		// the udp associations follow the egress
+		if laddr, ok := udpLocalAddr(d); !ok || laddr.String() != local {
+			t.Errorf("%s udp bind to %s", egress, laddr)
+		}
+	}
+	d, _ := NewDialer("socks5://127.0.0.1:1080")
+	if _, ok := udpLocalAddr(d); ok {
+		t.Errorf("udp via the proxy chain")
+	}
+}
+
+func TestUpstreamDialer(t *testing.T) {
+	echo := startEchoSvr()
+	defer echo.Close()
+	proxy := startUpstreamProxy(testAuthSys{"user": "pass"})
+	defer proxy.Close()
+	var addr = proxy.Addr().String()
+
+	for _, scheme := range []string{EGRESS_SOCKS5, EGRESS_HTTP} {
+		d, _ := NewDialer(scheme + "://user:pass@" + addr)
+		conn, e := d.Dial("tcp", echo.Addr().String())
+		if e != nil {
+			t.Errorf("%s dial error %v", scheme, e)
+			continue
+		}
+		var msg = []byte("hello " + scheme)
+		var buf = make([]byte, len(msg))
+		conn.Write(msg)
+		if _, e = io.ReadFull(conn, buf); e != nil || string(buf) != string(msg) {
+			t.Errorf("%s echo %q error %v", scheme, buf, e)
+		}
+		conn.Close()
+
+		// wrong password
+		d, _ = NewDialer(scheme + "://user:wrong@" + addr)
+		if conn, e = d.Dial("tcp", echo.Addr().String()); e == nil {
+			t.Errorf("%s dial with wrong password", scheme)
+			conn.Close()
+		}
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	ln, e := net.Listen("tcp", "[::]:0")
+	if e != nil {
+		t.Skip("ipv6 is unavailable", e)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	var port = ln.Addr().(*net.TCPAddr).Port
+	var target = net.JoinHostPort("dual.test", strconv.Itoa(port))
+	var lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("::1")}}, nil
+	}
+	var delay = time.Millisecond * 100
+	var dial = func(prefer, network string, slow string) (string, time.Duration) {
+		d := newHappyDialer(prefer, delay)
+		d.lookup = lookup
+		// the slow family hangs before connecting
+		d.Control = func(_, address string, _ syscall.RawConn) error {
+			if slow != NULL && strings.HasPrefix(address, slow) {
+				time.Sleep(delay * 5)
+			}
+			return nil
+		}
+		start := time.Now()
+		conn, e := d.Dial(network, target)
+		if e != nil {
+			t.Fatal("dial", prefer, e)
+		}
+		defer conn.Close()
+		return addrFamily(conn.RemoteAddr()), time.Since(start)
+	}
+
+	if f, _ := dial(FAMILY_IPV6, "tcp", NULL); f != FAMILY_IPV6 {
+		t.Errorf("prefer ipv6 but %s", f)
+	}
+	if f, _ := dial(FAMILY_IPV4, "tcp", NULL); f != FAMILY_IPV4 {
+		t.Errorf("prefer ipv4 but %s", f)
+	}
+	if f, _ := dial(FAMILY_IPV4, "tcp6", NULL); f != FAMILY_IPV6 {
+		t.Errorf("tcp6 but %s", f)
+	}
+	// fall back to ipv4 after the delay
+	if f, elapsed := dial(FAMILY_IPV6, "tcp", "[::1]"); f != FAMILY_IPV4 || elapsed < delay || elapsed >= delay*5 {
+		t.Errorf("fallback to %s elapsed %s", f, elapsed)
+	}
+	// fall back to ipv6 at once if ipv4 failed
+	d := newHappyDialer(FAMILY_IPV4, time.Second)
+	d.lookup = lookup
+	d.Control = func(_, address string, _ syscall.RawConn) error {
+		if strings.HasPrefix(address, "127.") {
+			return syscall.ECONNREFUSED
+		}
+		return nil
+	}
+	start := time.Now()
+	if conn, e := d.Dial("tcp", target); e != nil || time.Since(start) >= time.Second {
+		t.Errorf("fallback error %v elapsed %s", e, time.Since(start))
+	} else {
+		conn.Close()
+	}
+	d.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	if _, e = d.Dial("tcp6", target); e == nil {
+		t.Error("dial tcp6 without ipv6 address")
+	}
+}
@@ -0,0 +1,515 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ex "github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	DNS_QUERY_TIMEOUT = time.Second * 5
+	DNS_TCP_IDLE      = time.Second * 30
+	DNS_CACHE_SIZE    = 4096
+	DNS_HEADER_LEN    = 12
+	DNS_UDP_SIZE      = 512
+	DNS_MAX_MSG       = FRAME_MAX_LEN - FRAME_HEADER_LEN
+	// the fallback if nameserver was unknown, same as the behavior of go
+	DNS_DEFAULT_UPSTREAM = "127.0.0.1:53"
+	DNS_RESOLV_CONF      = "/etc/resolv.conf"
+)
+
+const (
+	DNS_TYPE_A         = 1
+	DNS_TYPE_AAAA      = 28
+	DNS_TYPE_OPT       = 41
+	DNS_RCODE_NOERROR  = 0
+	DNS_RCODE_SERVFAIL = 2
+	DNS_RCODE_NXDOMAIN = 3
+)
+
+var (
+	INVALID_DNS_MSG = ex.New("Invalid dns message")
+	DNS_TIMEOUT     = ex.New("DNS query timeout")
+	DNS_NO_ADDR     = ex.New("No address of host")
+)
+
+// the position of a resource record
+type dnsRecord struct {
+	rrType uint16
+	class  uint16
+	ttlOff int
+}
+
+// walk the message without decompressing names
+// returns the end of question section and all resource records.
+func dnsParse(msg []byte) (qEnd int, records []dnsRecord, err error) {
+	if len(msg) < DNS_HEADER_LEN {
+		return 0, nil, INVALID_DNS_MSG
+	}
+	var (
+		qdCount = int(binary.BigEndian.Uint16(msg[4:]))
+		rrCount = int(binary.BigEndian.Uint16(msg[6:])) +
+			int(binary.BigEndian.Uint16(msg[8:])) +
+			int(binary.BigEndian.Uint16(msg[10:]))
+		off = DNS_HEADER_LEN
+	)
+	if qdCount != 1 {
+		return 0, nil, INVALID_DNS_MSG
+	}
+	// qname | qtype | qclass
+	if off, err = dnsSkipName(msg, off); err != nil || off+4 > len(msg) {
+		return 0, nil, INVALID_DNS_MSG
+	}
+	qEnd = off + 4
+	off = qEnd
+	// name | type | class | ttl | rdlength | rdata
+	for i := 0; i < rrCount; i++ {
+		if off, err = dnsSkipName(msg, off); err != nil || off+10 > len(msg) {
+			return 0, nil, INVALID_DNS_MSG
+		}
+		records = append(records, dnsRecord{
+			rrType: binary.BigEndian.Uint16(msg[off:]),
+			class:  binary.BigEndian.Uint16(msg[off+2:]),
+			ttlOff: off + 4,
+		})
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+		if off > len(msg) {
+			return 0, nil, INVALID_DNS_MSG
+		}
+	}
+	return qEnd, records, nil
+}
+
+func dnsSkipName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0: // pointer
+			return off + 2, nil
+		case l&0xc0 != 0:
+			return 0, INVALID_DNS_MSG
+		}
+		off += l + 1
+	}
+	return 0, INVALID_DNS_MSG
+}
+
+// a recursive query of the name with the type
+func dnsNewQuery(name string, qtype uint16) ([]byte, error) {
+	msg := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, INVALID_DNS_MSG.Apply(name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	return msg, nil
+}
+
+// the first address of the type in answer section
+func dnsAnswerIP(msg []byte, qtype uint16) net.IP {
+	_, records, err := dnsParse(msg)
+	if err != nil {
+		return nil
+	}
+	var anCount = int(binary.BigEndian.Uint16(msg[6:]))
+	for i, r := range records {
+		if i >= anCount {
+			break
+		}
+		// ttl | rdlength | rdata
+		var rdLen = int(binary.BigEndian.Uint16(msg[r.ttlOff+4:]))
+		var rdata = msg[r.ttlOff+6 : r.ttlOff+6+rdLen]
+		if r.rrType == qtype && r.class == 1 && (rdLen == net.IPv4len || rdLen == net.IPv6len) {
+			return net.IP(append([]byte(nil), rdata...))
+		}
+	}
+	return nil
+}
+
+// readable qname for logging
+func dnsQuestionName(msg []byte) string {
+	var labels []string
+	for off := DNS_HEADER_LEN; off < len(msg); {
+		l := int(msg[off])
+		if l == 0 || l&0xc0 != 0 || off+1+l > len(msg) {
+			break
+		}
+		labels = append(labels, string(msg[off+1:off+1+l]))
+		off += l + 1
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+// the udp payload size advertised by the EDNS of query
+func dnsPayloadSize(records []dnsRecord) int {
+	for _, r := range records {
+		if r.rrType == DNS_TYPE_OPT && r.class > DNS_UDP_SIZE {
+			return int(r.class)
+		}
+	}
+	return DNS_UDP_SIZE
+}
+
+// header and question only, with the specified rcode or truncation bit
+func dnsReduce(msg []byte, qEnd int, rcode byte, truncated bool) []byte {
+	reply := make([]byte, qEnd)
+	copy(reply, msg)
+	reply[2] |= 0x80 // QR
+	if truncated {
+		reply[2] |= 0x02 // TC
+	}
+	reply[3] = reply[3]&0xf0 | rcode
+	for i := 6; i < DNS_HEADER_LEN; i++ {
+		reply[i] = 0
+	}
+	return reply
+}
+
+// ------------------------------
+// dnsCacheEntry
+// ------------------------------
+type dnsCacheEntry struct {
+	msg    []byte
+	ttls   []int // offsets of ttl fields
+	stored time.Time
+}
+
+// copy the cached answer for the query with the remaining ttl
+func (e *dnsCacheEntry) answer(query []byte) []byte {
+	reply := make([]byte, len(e.msg))
+	copy(reply, e.msg)
+	copy(reply, query[:2]) // id
+	elapsed := uint32(time.Since(e.stored) / time.Second)
+	for _, off := range e.ttls {
+		ttl := binary.BigEndian.Uint32(reply[off:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(reply[off:], ttl)
+	}
+	return reply
+}
+
+// the minimum ttl of records determines the lifetime of cached answer
+// returns nil if the reply is not cacheable.
+func newDnsCacheEntry(reply []byte, records []dnsRecord) (*dnsCacheEntry, uint32) {
+	rcode := reply[3] & 0xf
+	if reply[2]&0x02 != 0 || (rcode != DNS_RCODE_NOERROR && rcode != DNS_RCODE_NXDOMAIN) {
+		return nil, 0
+	}
+	var (
+		e      = &dnsCacheEntry{msg: reply, stored: time.Now()}
+		minTTL = ^uint32(0)
+	)
+	for _, r := range records {
+		// ttl field of OPT is the extended rcode and flags
+		if r.rrType == DNS_TYPE_OPT {
+			continue
+		}
+		e.ttls = append(e.ttls, r.ttlOff)
+		if ttl := binary.BigEndian.Uint32(reply[r.ttlOff:]); ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+	if len(e.ttls) == 0 || minTTL == 0 {
+		return nil, 0
+	}
+	return e, minTTL
+}
+
+// ------------------------------
+// dnsRelay
+// ------------------------------
+// Client: send the queries through tunnel and cache the answers.
+// Server: resolve the queries with the upstream nameserver.
+type dnsRelay struct {
+	lock     sync.Mutex
+	upstream string
+	pending  map[uint16]chan []byte
+	cache    *expiringCache
+	// query ids, independent of the stream sids
+	seq uint16
+}
+
+// skip zero and the ids still pending, should be called under lock
+func (r *dnsRelay) nextId() uint16 {
+	for {
+		r.seq++
+		if _, y := r.pending[r.seq]; r.seq != 0 && !y {
+			return r.seq
+		}
+	}
+}
+
+func newClientDnsRelay() *dnsRelay {
+	return &dnsRelay{
+		pending: make(map[uint16]chan []byte),
+		cache:   newExpiringCache(DNS_CACHE_SIZE),
+	}
+}
+
+func newServerDnsRelay(upstream string) *dnsRelay {
+	if upstream == NULL {
+		upstream = systemNameserver()
+	}
+	return &dnsRelay{upstream: upstream}
+}
+
+// the first nameserver of resolv.conf
+func systemNameserver() string {
+	if f, err := os.Open(DNS_RESOLV_CONF); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 1 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return DNS_DEFAULT_UPSTREAM
+}
+
+// client: resolve the query from cache or through tunnel
+func (r *dnsRelay) query(mux *multiplexer, msg []byte) ([]byte, error) {
+	qEnd, _, err := dnsParse(msg)
+	if err != nil {
+		return nil, err
+	}
+	// qname is case-insensitive
+	var key = string(bytes.ToLower(msg[DNS_HEADER_LEN:qEnd]))
+	if v, y := r.cache.get(key); y {
+		if log.V(log.LV_REQ) {
+			log.Infoln("DNS cached", dnsQuestionName(msg))
+		}
+		return v.(*dnsCacheEntry).answer(msg), nil
+	}
+	var tun *Conn
+	if mux != nil && mux.pool != nil {
+		tun = mux.pool.Select()
+	}
+	if tun == nil {
+		return nil, ERR_TUN_NA
+	}
+
+	var wait = make(chan []byte, 1)
+	r.lock.Lock()
+	var sid = r.nextId()
+	r.pending[sid] = wait
+	r.lock.Unlock()
+	defer func() {
+		r.lock.Lock()
+		delete(r.pending, sid)
+		r.lock.Unlock()
+	}()
+
+	if log.V(log.LV_REQ) {
+		log.Infof("DNS->[%s] sid=%d\n", dnsQuestionName(msg), sid)
+	}
+	var buf = make([]byte, FRAME_HEADER_LEN+len(msg))
+	pack(buf, FRAME_ACTION_DNS_REQUEST, sid, msg)
+	if err = frameWriteBuffer(tun, buf); err != nil {
+		return nil, err
+	}
+
+	var reply []byte
+	select {
+	case reply = <-wait:
+	case <-time.After(DNS_QUERY_TIMEOUT):
+		return nil, DNS_TIMEOUT.Apply(dnsQuestionName(msg))
+	}
+	if _, records, e := dnsParse(reply); e == nil {
+		if entry, ttl := newDnsCacheEntry(reply, records); entry != nil {
+			r.cache.set(key, entry, entry.stored.Add(time.Duration(ttl)*time.Second))
+		}
+	}
+	return reply, nil
+}
+
+// client: resolve the host through tunnel, ipv4 is preferred
+func (r *dnsRelay) lookupIP(mux *multiplexer, host string) (net.IP, error) {
+	var err error
+	for _, qtype := range []uint16{DNS_TYPE_A, DNS_TYPE_AAAA} {
+		var query, reply []byte
+		if query, err = dnsNewQuery(host, qtype); err != nil {
+			return nil, err
+		}
+		if reply, err = r.query(mux, query); err != nil {
+			return nil, err
+		}
+		if ip := dnsAnswerIP(reply, qtype); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, DNS_NO_ADDR.Apply(host)
+}
+
+// client: the reply from tunnel
+func (r *dnsRelay) reply(frm *frame) {
+	defer frm.free()
+	var reply = make([]byte, len(frm.data))
+	copy(reply, frm.data)
+	r.lock.Lock()
+	wait := r.pending[frm.sid]
+	r.lock.Unlock()
+	if wait == nil {
+		if log.V(log.LV_WARN) {
+			log.Warningln("Peer sent dns reply to an unexisted query.", frm)
+		}
+		return
+	}
+	select {
+	case wait <- reply:
+	default:
+	}
+}
+
+// server: resolve the query then reply to tunnel
+func (r *dnsRelay) exchange(tun *Conn, frm *frame) {
+	defer frm.free()
+	qEnd, _, err := dnsParse(frm.data)
+	if err != nil {
+		if log.V(log.LV_WARN) {
+			log.Warningln(err, "from", tun.identifier)
+		}
+		return
+	}
+	reply, err := dnsExchange(r.upstream, frm.data)
+	if err == nil && len(reply) > DNS_MAX_MSG {
+		reply = dnsReduce(frm.data, qEnd, DNS_RCODE_NOERROR, true)
+	} else if err != nil {
+		log.Warningf("DNS query [%s] error: %s\n", dnsQuestionName(frm.data), err)
+		reply = dnsReduce(frm.data, qEnd, DNS_RCODE_SERVFAIL, false)
+	}
+	var buf = make([]byte, FRAME_HEADER_LEN+len(reply))
+	pack(buf, FRAME_ACTION_DNS_REPLY, frm.sid, reply)
+	frameWriteBuffer(tun, buf)
+}
+
+// query upstream via udp, then retry via tcp if truncated.
+func dnsExchange(upstream string, msg []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", upstream, DNS_QUERY_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DNS_QUERY_TIMEOUT))
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var buf = make([]byte, DNS_MAX_MSG)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore the unmatched id
+		if n < DNS_HEADER_LEN || buf[0] != msg[0] || buf[1] != msg[1] {
+			continue
+		}
+		if buf[2]&0x02 == 0 {
+			return buf[:n], nil
+		}
+		break
+	}
+	// truncated
+	tcpConn, err := net.DialTimeout("tcp", upstream, DNS_QUERY_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpConn.Close()
+	tcpConn.SetDeadline(time.Now().Add(DNS_QUERY_TIMEOUT))
+	if err = writeDnsTCP(tcpConn, msg); err != nil {
+		return nil, err
+	}
+	return readDnsTCP(tcpConn)
+}
+
+// length-prefixed message
+func readDnsTCP(conn net.Conn) ([]byte, error) {
+	var head = make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+	var msg = make([]byte, binary.BigEndian.Uint16(head))
+	_, err := io.ReadFull(conn, msg)
+	return msg, err
+}
+
+func writeDnsTCP(conn net.Conn, msg []byte) error {
+	var buf = make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := conn.Write(buf)
+	return err
+}
+
+// client: serve the local dns queries via udp
+func (c *Client) DNSPacketServe(conn *net.UDPConn) {
+	var buf = make([]byte, DNS_MAX_MSG)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if IsClosedError(err) {
+				return
+			}
+			continue
+		}
+		msg := make([]byte, n)
+		copy(msg, buf)
+		go func() {
+			qEnd, records, err := dnsParse(msg)
+			if err != nil {
+				return
+			}
+			reply, err := c.dns.query(c.selectMux(), msg)
+			if err != nil {
+				log.Warningln(err)
+				reply = dnsReduce(msg, qEnd, DNS_RCODE_SERVFAIL, false)
+			} else if len(reply) > dnsPayloadSize(records) {
+				reply = dnsReduce(msg, qEnd, DNS_RCODE_NOERROR, true)
+			}
+			conn.WriteToUDP(reply, from)
+		}()
+	}
+}
+
+// client: serve the local dns queries via tcp
+func (c *Client) DNSServe(conn *net.TCPConn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(DNS_TCP_IDLE))
+		msg, err := readDnsTCP(conn)
+		if err != nil {
+			return
+		}
+		qEnd, _, err := dnsParse(msg)
+		if err != nil {
+			return
+		}
+		reply, err := c.dns.query(c.selectMux(), msg)
+		if err != nil {
+			log.Warningln(err)
+			reply = dnsReduce(msg, qEnd, DNS_RCODE_SERVFAIL, false)
+		}
+		if writeDnsTCP(conn, reply) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func dnsTestQuery(id uint16, name string) []byte {
+	msg := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(msg, id)
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, 0, 1, 0, 1)
+}
+
+// answer A record with ttl=60
+// the names prefixed with "tc" will be truncated via udp
+func startDnsUpstream(counter *int32) string {
+	conn, e := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3)})
+	ThrowErr(e)
+	ln, e := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 3), Port: conn.LocalAddr().(*net.UDPAddr).Port})
+	ThrowErr(e)
+	answer := func(query []byte, tc bool) []byte {
+		atomic.AddInt32(counter, 1)
+		reply := append([]byte{}, query...)
+		reply[2] |= 0x80
+		if tc {
+			reply[2] |= 0x02
+			return reply
+		}
+		reply[7] = 1
+		return append(reply, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 1, 2, 3)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, e := conn.ReadFromUDP(buf)
+			if e != nil {
+				return
+			}
+			query := buf[:n]
+			conn.WriteToUDP(answer(query, dnsQuestionName(query)[:2] == "tc"), from)
+		}
+	}()
+	go func() {
+		for {
+			c, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			if query, e := readDnsTCP(c); e == nil {
+				writeDnsTCP(c, answer(query, false))
+			}
+			c.Close()
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDnsRelay(t *testing.T) {
+	startEmulation()
+	var counter int32
+	server.dns = newServerDnsRelay(startDnsUpstream(&counter))
+	client.dns = newClientDnsRelay()
+	defer func() {
+		server.dns, client.dns = nil, nil
+	}()
+
+	for i, name := range []string{"example.com", "EXAMPLE.com", "tc.example.com"} {
+		query := dnsTestQuery(uint16(i+100), name)
+		reply, err := client.dns.query(client, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply[:2], query[:2]) {
+			t.Errorf("incorrect id [% x]", reply[:2])
+		}
+		if !bytes.HasSuffix(reply, []byte{0, 4, 10, 1, 2, 3}) {
+			t.Errorf("incorrect answer of %s [% x]", name, reply)
+		}
+	}
+	// 1 for example.com and the cached, 2 for the truncated
+	if n := atomic.LoadInt32(&counter); n != 3 {
+		t.Errorf("upstream received %d queries", n)
+	}
+	// resolve for the ip rules
+	if ip, err := client.dns.lookupIP(client, "intra.example.com"); err != nil || !ip.Equal(net.IPv4(10, 1, 2, 3)) {
+		t.Errorf("lookup ip=%v err=%v", ip, err)
+	}
+	assertLength(t, "client.dns.pending", client.dns.pending, 0)
+}
+
+func TestDnsQueryId(t *testing.T) {
+	r := newClientDnsRelay()
+	r.seq = 0xfffe
+	r.pending[1] = nil
+	if id := r.nextId(); id != 0xffff {
+		t.Errorf("id=%#x", id)
+	}
+	// skip zero and the pending one
+	if id := r.nextId(); id != 2 {
+		t.Errorf("id=%#x", id)
+	}
+}
+
+func TestDnsCacheEntry(t *testing.T) {
+	query := dnsTestQuery(1, "example.com")
+	reply := append(append([]byte{}, query...), 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 1, 2, 3)
+	reply[2] |= 0x80
+	reply[7] = 1
+	_, records, err := dnsParse(reply)
+	if err != nil || len(records) != 1 {
+		t.Fatal("parse", err, records)
+	}
+	entry, ttl := newDnsCacheEntry(reply, records)
+	if entry == nil || ttl != 60 {
+		t.Fatal("entry", entry, ttl)
+	}
+	entry.stored = entry.stored.Add(-10e9)
+	answer := entry.answer(dnsTestQuery(2, "example.com"))
+	if answer[1] != 2 || binary.BigEndian.Uint32(answer[records[0].ttlOff:]) != 50 {
+		t.Errorf("incorrect answer [% x]", answer)
+	}
+
+	// servfail is not cacheable
+	reply[3] |= DNS_RCODE_SERVFAIL
+	if entry, _ = newDnsCacheEntry(reply, records); entry != nil {
+		t.Errorf("servfail should not be cached")
+	}
+}
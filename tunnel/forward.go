@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"net"
+	"strings"
+
+	ex "github.com/Lafeng/deblocus/exception"
+)
+
+const FORWARD_SEPARATOR = "->"
+
+// static local port forwarding
+// Forward = 127.0.0.1:5432 -> db.internal:5432
+type LocalForward struct {
+	ListenAddr *net.TCPAddr
+	Target     string
+}
+
+func (f *LocalForward) String() string {
+	return f.ListenAddr.String() + " " + FORWARD_SEPARATOR + " " + f.Target
+}
+
+// listen -> target
+func parseForwardPair(value string) (listen, target string, err error) {
+	pos := strings.Index(value, FORWARD_SEPARATOR)
+	if pos < 0 {
+		return NULL, NULL, CONF_ERROR.Apply("Forward " + value)
+	}
+	listen = strings.TrimSpace(value[:pos])
+	target = strings.TrimSpace(value[pos+len(FORWARD_SEPARATOR):])
+	if listen == NULL || target == NULL {
+		return NULL, NULL, CONF_ERROR.Apply("Forward " + value)
+	}
+	if err = IsValidHost(target); err != nil {
+		return NULL, NULL, CONF_ERROR.Apply(err)
+	}
+	return
+}
+
+func parseLocalForward(value string) (*LocalForward, error) {
+	listen, target, err := parseForwardPair(value)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveTCPAddr("tcp", listen)
+	if err != nil {
+		return nil, LOCAL_BIND_ERROR.Apply(err)
+	}
+	return &LocalForward{addr, target}, nil
+}
+
+// pipe the accepted connection to the fixed target
+func (c *Client) ForwardServe(conn net.Conn, target string) {
+	var done bool
+	defer func() {
+		ex.Catch(recover(), nil)
+		if !done {
+			SafeClose(conn)
+		}
+	}()
+	c.selectMux().HandleRequest("FORWARD", conn, target)
+	done = true
+}
@@ -0,0 +1,24 @@
+package tunnel
+
+import (
+	"testing"
+)
+
+func TestParseLocalForward(t *testing.T) {
+	fwd, err := parseLocalForward("127.0.0.1:5432 -> db.internal:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fwd.ListenAddr.String() != "127.0.0.1:5432" || fwd.Target != "db.internal:5432" {
+		t.Errorf("parsed %s", fwd)
+	}
+	fwd, err = parseLocalForward("[::1]:8080->[fd00::1]:80")
+	if err != nil || fwd.ListenAddr.Port != 8080 || fwd.Target != "[fd00::1]:80" {
+		t.Errorf("parsed %v err=%v", fwd, err)
+	}
+	for _, v := range []string{"127.0.0.1:5432", "-> db:5432", "127.0.0.1:5432 -> db", "127.0.0.1:5432 ->"} {
+		if _, err = parseLocalForward(v); err == nil {
+			t.Errorf("expected error of %q", v)
+		}
+	}
+}
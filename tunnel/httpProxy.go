@@ -0,0 +1,258 @@
+package tunnel
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	HTTP_KEEPALIVE_TIMEOUT = time.Minute
+)
+
+// ------------------------------
+// httpStream
+// ------------------------------
+// A virtual connection carries the requests to the same host.
+// As an edge connection, it reads the requests were written into reqW,
+// and writes the responses which will be copied to the client
+// after the responses of previous stream.
+// The responses are parsed while copying to know when the pending
+// requests were all answered, then the finished stream could be closed
+// at once instead of waiting for the upstream which may keep alive.
+type httpStream struct {
+	target   string
+	client   net.Conn
+	reqR     net.Conn // edge side
+	reqW     net.Conn
+	respR    net.Conn
+	respW    net.Conn // edge side
+	done     chan bool
+	lock     sync.Mutex
+	reqs     []*http.Request // waiting for responses
+	pending  int
+	finished bool
+}
+
+func newHttpStream(client net.Conn, target string, prev *httpStream) *httpStream {
+	s := &httpStream{
+		target: target,
+		client: client,
+		done:   make(chan bool),
+	}
+	s.reqR, s.reqW = net.Pipe()
+	s.respR, s.respW = net.Pipe()
+	go func() {
+		if prev != nil {
+			<-prev.done
+		}
+		s.copyResponses()
+		s.destroy()
+		close(s.done)
+	}()
+	return s
+}
+
+// copy raw responses to client, and parse them from the copied
+func (s *httpStream) copyResponses() {
+	var reader = bufio.NewReader(io.TeeReader(s.respR, s.client))
+	for {
+		// wait for a response or closing
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
+		req := s.next()
+		if req == nil {
+			// unsolicited, just copy the rest
+			io.Copy(ioutil.Discard, reader)
+			return
+		}
+		resp, err := http.ReadResponse(reader, req)
+		// skip the informational responses
+		for err == nil && resp.StatusCode/100 == 1 && resp.StatusCode != http.StatusSwitchingProtocols {
+			resp, err = http.ReadResponse(reader, req)
+		}
+		if err != nil {
+			return
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			io.Copy(ioutil.Discard, reader)
+			return
+		}
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.Close || s.answered() {
+			return
+		}
+	}
+}
+
+// send the request to stream
+func (s *httpStream) request(req *http.Request) error {
+	s.lock.Lock()
+	s.reqs = append(s.reqs, req)
+	s.pending++
+	s.lock.Unlock()
+	return req.Write(s.reqW)
+}
+
+func (s *httpStream) next() *http.Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.reqs) == 0 {
+		return nil
+	}
+	req := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return req
+}
+
+// a response was completed, returns whether all were answered after finished
+func (s *httpStream) answered() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending--
+	return s.finished && s.pending <= 0
+}
+
+func (s *httpStream) Read(b []byte) (int, error) {
+	return s.reqR.Read(b)
+}
+
+func (s *httpStream) Write(b []byte) (int, error) {
+	return s.respW.Write(b)
+}
+
+func (s *httpStream) CloseRead() error {
+	return s.reqR.Close()
+}
+
+func (s *httpStream) CloseWrite() error {
+	return s.respW.Close()
+}
+
+func (s *httpStream) Close() error {
+	s.reqR.Close()
+	return s.respW.Close()
+}
+
+func (s *httpStream) LocalAddr() net.Addr {
+	return s.client.LocalAddr()
+}
+
+func (s *httpStream) RemoteAddr() net.Addr {
+	return s.client.RemoteAddr()
+}
+
+func (s *httpStream) SetDeadline(t time.Time) error {
+	s.reqR.SetReadDeadline(t)
+	return s.respW.SetWriteDeadline(t)
+}
+
+func (s *httpStream) SetReadDeadline(t time.Time) error {
+	return s.reqR.SetReadDeadline(t)
+}
+
+func (s *httpStream) SetWriteDeadline(t time.Time) error {
+	return s.respW.SetWriteDeadline(t)
+}
+
+// all responses were sent to client
+func (s *httpStream) isDone() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// no more requests, the stream will be closed after the pending responses.
+func (s *httpStream) finish() {
+	s.reqW.Close()
+	s.lock.Lock()
+	s.finished = true
+	var idle = s.pending <= 0
+	s.lock.Unlock()
+	if idle {
+		s.destroy()
+	}
+}
+
+func (s *httpStream) destroy() {
+	s.reqW.Close()
+	s.Close()
+	s.respR.Close()
+}
+
+// serve the plain http requests of a keep-alive connection
+// the requests to the same host will be sent via the same stream,
+// and a new stream will be opened if the host was changed,
+// meanwhile the previous one is finished without waiting.
+func (c *Client) httpProxyServe(conn *pushbackInputStream) {
+	var (
+		reader  = bufio.NewReader(conn)
+		stream  *httpStream
+		streams []*httpStream // sending responses
+	)
+	defer func() {
+		for _, s := range streams {
+			s.destroy()
+		}
+		SafeClose(conn)
+	}()
+
+	for n := 0; ; n++ {
+		conn.SetReadDeadline(time.Now().Add(HTTP_KEEPALIVE_TIMEOUT))
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		// the first one was verified and rewritten by handshake
+		if n > 0 {
+			// only the plain proxy requests could follow
+			if req.Method == "CONNECT" || req.RequestURI[0] == '/' {
+				if log.V(log.LV_WARN) {
+					log.Warningln("Unexpected", req.Method, req.RequestURI, "in keep-alive connection")
+				}
+				return
+			}
+			if c.proxyAuth != nil {
+				if err = httpProxyAuthenticate(c.proxyAuth, req); err != nil {
+					log.Warningln(err)
+					writeProxyAuthRequired(conn)
+					return
+				}
+			}
+		}
+		target, err := httpTargetOf(req.Host, "80")
+		if err != nil {
+			log.Warningln(err)
+			return
+		}
+		if stream == nil || stream.target != target || stream.isDone() {
+			if stream != nil {
+				stream.finish()
+			}
+			var pending = streams[:0]
+			for _, s := range streams {
+				if !s.isDone() {
+					pending = append(pending, s)
+				}
+			}
+			stream = newHttpStream(conn, target, stream)
+			streams = append(pending, stream)
+			go c.dispatch("HTTP", stream, target)
+		}
+		stripProxyHeaders(req)
+		if err = stream.request(req); err != nil {
+			return
+		}
+	}
+}
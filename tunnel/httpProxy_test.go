@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// reply name|path|remote
+func startHttpSvr(name string) net.Listener {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	ThrowErr(e)
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s", name, r.URL.Path, r.RemoteAddr)
+	}))
+	return ln
+}
+
+// the test servers are on loopback, proxy them through the tunnel
+func proxyIntranet() (restore func()) {
+	var rules = implicitRules
+	implicitRules = nil
+	return func() { implicitRules = rules }
+}
+
+func TestHttpKeepAlive(t *testing.T) {
+	startEmulation()
+	defer proxyIntranet()()
+	svrA, svrB := startHttpSvr("A"), startHttpSvr("B")
+	defer svrA.Close()
+	defer svrB.Close()
+	c := clientOf(client)
+
+	app, peer := tcpPair()
+	go c.ClientServe(peer)
+
+	var reqs = []struct{ host, path string }{
+		{svrA.Addr().String(), "/1"},
+		{svrA.Addr().String(), "/2"},
+		{svrB.Addr().String(), "/3"},
+		{svrA.Addr().String(), "/4"},
+	}
+	// pipelined
+	for _, r := range reqs {
+		fmt.Fprintf(app, "GET http://%s%s HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n\r\n", r.host, r.path, r.host)
+	}
+	var reader = bufio.NewReader(app)
+	var remotes []string
+	for i, r := range reqs {
+		resp, e := http.ReadResponse(reader, nil)
+		if e != nil {
+			t.Fatalf("read response %d error %v", i, e)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var name, path, remote string
+		fmt.Sscanf(string(body), "%1s|%2s|%s", &name, &path, &remote)
+		if (name == "A") != (r.host == svrA.Addr().String()) || path != r.path {
+			t.Errorf("response %d is %s", i, body)
+		}
+		remotes = append(remotes, remote)
+	}
+	// the same host reuses the stream, and the switched host opens a new one
+	if remotes[0] != remotes[1] || remotes[1] == remotes[3] {
+		t.Errorf("unexpected remotes %v", remotes)
+	}
+	app.Close()
+	rest(3)
+	checkFinishedLength(t)
+}
+
+// keep the connections open even if the client half-closed, until quit
+func startStickyHttpSvr(quit chan bool) net.Listener {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	ThrowErr(e)
+	go func() {
+		for {
+			conn, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			go func() {
+				var reader = bufio.NewReader(conn)
+				for {
+					if _, e := http.ReadRequest(reader); e != nil {
+						break
+					}
+					fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+				}
+				<-quit
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestHttpSwitchHost(t *testing.T) {
+	startEmulation()
+	defer proxyIntranet()()
+	quit := make(chan bool)
+	svrA, svrB := startStickyHttpSvr(quit), startHttpSvr("B")
+	defer svrA.Close()
+	defer svrB.Close()
+	c := clientOf(client)
+
+	app, peer := tcpPair()
+	go c.ClientServe(peer)
+	var reader = bufio.NewReader(app)
+	// the upstream keeps alive, but switching host must not wait for it
+	for i, host := range []string{svrA.Addr().String(), svrB.Addr().String(), svrA.Addr().String()} {
+		fmt.Fprintf(app, "GET http://%s/%d HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n\r\n", host, i, host)
+		app.SetReadDeadline(time.Now().Add(time.Second * 3))
+		resp, e := http.ReadResponse(reader, nil)
+		if e != nil {
+			t.Fatalf("read response %d error %v", i, e)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	app.Close()
+	close(quit)
+	rest(3)
+	checkFinishedLength(t)
+}
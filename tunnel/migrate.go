@@ -0,0 +1,212 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+// Stream migration
+//
+// The sid of stream is unique in the multiplexer, but not bound to a tun.
+// Each side counts the sequence of sent and received data, and keeps the
+// sent data in the retransmit buffer until peer has consumed it.
+// When a tun was lost, the streams on it will be suspended, and then the
+// client moves them to another tun by exchanging the MIGRATE frames:
+//
+//	MIGRATE: | received sequence(8) | consumed sequence(8) |
+//
+// The server replies MIGRATE via the same tun, then both sides drop the
+// acknowledged data and retransmit the remainder after the received
+// sequence of peer. Only the client initiates, so they won't cross.
+// If all the tuns were lost, the server keeps the session for a while,
+// and the client resumes it by a token, then the streams are migrated
+// to the resumed tun. They are closed only if a new session was created.
+
+const (
+	// waiting for an available tun to resume the suspended stream
+	MIGRATE_TIMEOUT  = time.Second * 30
+	MIGRATE_INTERVAL = time.Second
+	MIGRATE_BODY_LEN = 16
+)
+
+// send the data in buf after the frame header
+func (e *edgeConn) sendData(buf []byte) {
+	e.wlock.Lock()
+	defer e.wlock.Unlock()
+	e.lock.Lock()
+	// the buf will be encrypted in place
+	e.retrans = append(e.retrans, buf[FRAME_HEADER_LEN:]...)
+	e.sent += uint64(len(buf) - FRAME_HEADER_LEN)
+	e.lock.Unlock()
+	if !e.suspended {
+		// the broken tun will be closed then the stream will be migrated.
+		frameWriteBuffer(e.tun, buf)
+	}
+}
+
+// tell peer to closeW, deferred if the stream was suspended
+func (e *edgeConn) sendClose() {
+	e.wlock.Lock()
+	defer e.wlock.Unlock()
+	if e.suspended {
+		e.finished = true
+	} else {
+		var buf = make([]byte, FRAME_HEADER_LEN)
+		pack(buf, FRAME_ACTION_CLOSE_W, e.sid, nil)
+		frameWriteBuffer(e.tun, buf)
+	}
+}
+
+// the received and consumed sequence
+// then only accept the data from rtun, see deliverData
+func (q *equeue) snapshot(rtun *Conn) (recvd, consumed uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	recvd, consumed = q.recvd, q.consumed
+	q.granted = consumed
+	q.rtun = rtun
+	return
+}
+
+// tell peer the received and consumed sequence via the new tun
+// must be called with wlock
+func (e *edgeConn) sendMigrate(tun *Conn, recvd, consumed uint64) error {
+	e.setTun(tun)
+	e.migrated = true
+
+	var buf = make([]byte, FRAME_HEADER_LEN+MIGRATE_BODY_LEN)
+	binary.BigEndian.PutUint64(buf[FRAME_HEADER_LEN:], recvd)
+	binary.BigEndian.PutUint64(buf[FRAME_HEADER_LEN+8:], consumed)
+	pack(buf, FRAME_ACTION_MIGRATE, e.sid, uint16(MIGRATE_BODY_LEN))
+	return frameWriteBuffer(tun, buf)
+}
+
+// the tun of edge was lost, then suspend the stream.
+// the client moves it to another tun, and the server waits for that.
+// the stream will be closed if it wasn't resumed in MIGRATE_TIMEOUT.
+func (e *edgeConn) migrate(lost *Conn) {
+	e.wlock.Lock()
+	if e.tun != lost || e.closed_gte(TCP_CLOSED) {
+		e.wlock.Unlock()
+		return
+	}
+	e.suspended, e.migrated = true, false
+	e.epoch++
+	var epoch = e.epoch
+	e.wlock.Unlock()
+
+	var p = e.mux
+	var deadline = time.Now().Add(MIGRATE_TIMEOUT)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt32(&p.status) < 0 || e.closed_gte(TCP_CLOSED) {
+			return
+		}
+		e.wlock.Lock()
+		// resumed, or lost again then in another migration
+		if !e.suspended || e.epoch != epoch {
+			e.wlock.Unlock()
+			return
+		}
+		if p.isClient && !e.migrated {
+			if pool := p.pool; pool != nil {
+				if tun := pool.Select(); tun != nil && tun != lost {
+					// drop the data until peer replies
+					recvd, consumed := e.queue.snapshot(nil)
+					if e.sendMigrate(tun, recvd, consumed) == nil {
+						if log.V(log.LV_ACT_FRM) {
+							log.Infof("Migrate %s sid=%d to tun %s\n", e.dest, e.sid, tun.identifier)
+						}
+					} else {
+						e.migrated, lost = false, tun
+					}
+				}
+			}
+		}
+		e.wlock.Unlock()
+		time.Sleep(MIGRATE_INTERVAL)
+	}
+	log.Warningf("Migrate %s sid=%d timeout\n", e.dest, e.sid)
+	e.deliver(&frame{action: FRAME_ACTION_CLOSE})
+}
+
+// received MIGRATE via the tun
+// it's called by the listener of tun, so must not be blocked.
+func (e *edgeConn) resume(tun *Conn, recvd, consumed uint64) {
+	var q = e.queue
+	if e.mux.isClient {
+		// only the reply of the latest request is expected
+		q.lock.Lock()
+		var expected = q.rtun == nil && e.getTun() == tun
+		if expected {
+			// peer will retransmit via this tun
+			q.rtun = tun
+		}
+		q.lock.Unlock()
+		if expected {
+			go e.retransmit(tun, recvd, consumed, nil)
+		}
+	} else {
+		// accept the request, and drop the data from the lost tun
+		ownRecvd, ownConsumed := q.snapshot(tun)
+		go e.retransmit(tun, recvd, consumed, []uint64{ownRecvd, ownConsumed})
+	}
+}
+
+// drop the data consumed by peer, and retransmit the data peer hasn't received
+// the server replies to peer with the own sequence at first.
+func (e *edgeConn) retransmit(tun *Conn, recvd, consumed uint64, reply []uint64) {
+	e.wlock.Lock()
+	defer e.wlock.Unlock()
+	if reply != nil {
+		if e.sendMigrate(tun, reply[0], reply[1]) != nil {
+			// the client will request again
+			e.suspended = true
+			return
+		}
+	} else if !e.suspended || e.tun != tun {
+		return
+	}
+
+	e.lock.Lock()
+	if consumed > e.acked && consumed <= e.sent {
+		e.retrans = e.retrans[consumed-e.acked:]
+		e.acked = consumed
+	}
+	if recvd < e.acked || recvd > e.sent {
+		e.lock.Unlock()
+		log.Warningf("Migrate %s sid=%d with an invalid sequence\n", e.dest, e.sid)
+		e.deliver(&frame{action: FRAME_ACTION_CLOSE})
+		return
+	}
+	var data = make([]byte, e.sent-recvd)
+	copy(data, e.retrans[recvd-e.acked:])
+	e.lock.Unlock()
+	e.suspended, e.migrated = false, false
+
+	if log.V(log.LV_ACT_FRM) {
+		log.Infof("Resume %s sid=%d retransmit=%d\n", e.dest, e.sid, len(data))
+	}
+	var maxLen = FRAME_MAX_LEN - FRAME_HEADER_LEN
+	for len(data) > 0 {
+		var n = len(data)
+		if n > maxLen {
+			n = maxLen
+		}
+		var buf = make([]byte, FRAME_HEADER_LEN+n)
+		pack(buf, FRAME_ACTION_DATA, e.sid, data[:n])
+		if frameWriteBuffer(tun, buf) != nil {
+			return
+		}
+		data = data[n:]
+	}
+	if e.finished {
+		e.finished = false
+		var buf = make([]byte, FRAME_HEADER_LEN)
+		pack(buf, FRAME_ACTION_CLOSE_W, e.sid, nil)
+		frameWriteBuffer(tun, buf)
+	}
+	e.wakeup()
+}
@@ -15,7 +15,6 @@ import (
 	ex "github.com/Lafeng/deblocus/exception"
 	log "github.com/Lafeng/deblocus/glog"
 	"github.com/cloudflare/golibs/bytepool"
-	"github.com/cloudflare/golibs/lrucache"
 )
 
 const (
@@ -29,6 +28,7 @@ const (
 	FRAME_ACTION_OPEN_DENIED         = 0x13
 	FRAME_ACTION_SLOWDOWN            = 0x20
 	FRAME_ACTION_DATA                = 0x21
+	FRAME_ACTION_MIGRATE             = 0x22
 	FRAME_ACTION_PING                = 0x30
 	FRAME_ACTION_PONG                = 0x31
 	FRAME_ACTION_TOKENS              = 0x40
@@ -36,6 +36,10 @@ const (
 	FRAME_ACTION_TOKEN_REPLY         = 0x42
 	FRAME_ACTION_DNS_REQUEST         = 0x51
 	FRAME_ACTION_DNS_REPLY           = 0x52
+	FRAME_ACTION_UDP_DATA            = 0x60
+	FRAME_ACTION_UDP_CLOSE           = 0x61
+	FRAME_ACTION_REVERSE             = 0x70
+	FRAME_ACTION_REKEY               = 0x80
 )
 
 const (
@@ -53,6 +57,13 @@ const (
 	FAST_OPEN_BUF_MAX_SIZE = 1 << 16 // 64k
 )
 
+const (
+	// receive window of each stream
+	STREAM_WINDOW = 1 << 20 // 1m
+	// grant credit to peer after consumed a quarter of window
+	STREAM_WINDOW_UPDATE = STREAM_WINDOW >> 2
+)
+
 const (
 	WAITING_OPEN_TIMEOUT = time.Second * 30
 	WRITE_TUN_TIMEOUT    = time.Second * 15
@@ -66,12 +77,12 @@ const (
 	ERR_UNKNOWN      = 0x0
 )
 
-const sid_max uint32 = 0xffff
+const sid_max = uint32(SID_REVERSE)
 
 var (
-	// [1, 0xfffe]
+	// [1, 0x7fff]
 	sid_seq      uint32
-	dialer       net.Dialer
+	dialer       = newHappyDialer(FAMILY_IPV6, HAPPY_FALLBACK_DELAY)
 	bytePoolOnce sync.Once
 	bytePool     *bytepool.BytePool
 )
@@ -87,7 +98,8 @@ var (
 type event byte
 
 const (
-	evt_tokens = event(1)
+	evt_tokens  = event(1)
+	evt_reverse = event(2)
 )
 
 type event_handler func(e event, msg ...interface{})
@@ -100,6 +112,7 @@ type idler struct {
 	waiting      bool
 	interval     time.Duration
 	lastPing     int64
+	lastRekey    int64 // the last checking of rekey interval
 	sRtt, devRtt int64
 }
 
@@ -132,6 +145,16 @@ func (i *idler) newRound(tun *Conn) {
 	} */
 }
 
+// the tun might be busy reading and rarely written
+func (i *idler) checkRekey(tun *Conn) error {
+	now := time.Now().UnixNano()
+	if now-i.lastRekey < int64(REKEY_CHECK_INTERVAL) {
+		return nil
+	}
+	i.lastRekey = now
+	return tun.rekeyIfDue()
+}
+
 func (i *idler) consumeError(er error) uint {
 	if i.enabled {
 		if netErr, y := er.(net.Error); y && netErr.Timeout() {
@@ -224,9 +247,6 @@ func (f *frame) free() {
 func initBytePool() {
 	bytePool = new(bytepool.BytePool)
 	bytePool.Init(time.Minute, 1<<20)
-	dialer.Timeout = time.Second * 3
-	dialer.DualStack = false
-	//dialer.DualStack = determineDualStack()
 }
 
 // --------------------
@@ -236,13 +256,18 @@ type multiplexer struct {
 	isClient  bool
 	pool      *ConnPool
 	router    *egressRouter
+	udpRouter *udpRouter
 	role      string
 	status    int32
 	pingCnt   int32 // received ping count
 	sRtt      int32
 	filter    Filterable
 	sLock     sync.Mutex
-	blacklist *lrucache.LRUCache
+	blacklist *expiringCache
+	reverse   map[string]string // client: reverse listen -> target
+	dns       *dnsRelay
+	dialer    Dialer // server: connecting to destinations
+	rekey     rekeyLimit
 }
 
 func newServerMultiplexer() *multiplexer {
@@ -253,6 +278,7 @@ func newServerMultiplexer() *multiplexer {
 		role:     "SVR",
 	}
 	m.router = newEgressRouter(m)
+	m.udpRouter = newUdpRouter(m)
 	return m
 }
 
@@ -262,9 +288,10 @@ func newClientMultiplexer() *multiplexer {
 		isClient:  true,
 		pool:      NewConnPool(),
 		role:      "CLT",
-		blacklist: lrucache.NewLRUCache(256),
+		blacklist: newExpiringCache(256),
 	}
 	m.router = newEgressRouter(m)
+	m.udpRouter = newUdpRouter(m)
 	return m
 }
 
@@ -284,20 +311,54 @@ func (p *multiplexer) destroy() {
 	p.sLock.Lock()
 	defer p.sLock.Unlock()
 	p.router.destroy() // destroy queue
+	p.udpRouter.destroy()
 	p.pool.destroy()
 	p.router = nil
+	p.udpRouter = nil
 	p.pool = nil
 }
 
+// count of the streams being served
+func (p *multiplexer) streamCount() int {
+	p.sLock.Lock()
+	defer p.sLock.Unlock()
+	if p.router == nil {
+		return 0
+	}
+	var r = p.router
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var n = len(r.preRegistry)
+	for _, e := range r.registry {
+		if !e.closed_gte(TCP_CLOSED) {
+			n++
+		}
+	}
+	return n
+}
+
 // serve client request
 func (p *multiplexer) HandleRequest(protocol string, req net.Conn, target string) {
+	p.openStream(protocol, req, target, nil)
+}
+
+// the result of opening will be sent to the channel if it's not nil
+func (p *multiplexer) openStream(protocol string, req net.Conn, target string, opened chan<- error) {
 	// select a tunnel to serve client request
 	if tun := p.pool.Select(); tun != nil {
-		sid := next_sid()
-		key := sessionKey(tun, sid)
+		sid := p.allocSid(!p.isClient) // reverse forwarding on server side
+		if sid == 0 {
+			log.Warningln("No free sid for", target)
+			SafeClose(req)
+			if opened != nil {
+				opened <- ERR_TUN_NA
+			}
+			return
+		}
 		// ingress: register in router table
 		// asynchronously transmit data from the tunnel to the edge connection
-		edge := p.router.register(key, target, tun, req, true)
+		edge := p.router.register(sid, target, tun, req, true)
+		edge.opened = opened
 		if log.V(log.LV_REQ) {
 			log.Infof("%s->[%s] from=%s sid=%d\n",
 				protocol, target, ipAddr(req.RemoteAddr()), sid)
@@ -307,7 +368,11 @@ func (p *multiplexer) HandleRequest(protocol string, req net.Conn, target string
 	} else {
 		// offline
 		log.Warningln(ERR_TUN_NA)
-		time.Sleep(time.Second)
+		if opened != nil {
+			opened <- ERR_TUN_NA
+		} else {
+			time.Sleep(time.Second)
+		}
 		SafeClose(req)
 	}
 }
@@ -319,7 +384,10 @@ func (p *multiplexer) onTunDisconnected(tun *Conn, handler event_handler) {
 		p.pool.Remove(tun)
 	}
 	if p.router != nil {
-		p.router.cleanOfTun(tun)
+		p.router.migrateOfTun(tun)
+	}
+	if p.udpRouter != nil {
+		p.udpRouter.cleanOfTun(tun)
 	}
 	// use finalizer to cleanup
 	runtime.SetFinalizer(tun, cleanupConn)
@@ -327,18 +395,20 @@ func (p *multiplexer) onTunDisconnected(tun *Conn, handler event_handler) {
 
 // This thread will listen on the tunnel, and process ingress data packets,
 // and route them to correct session.
-// TODO notify peer to slow down when queue increased too fast
+// The peer is slowed down by the credit of stream, see FRAME_ACTION_SLOWDOWN.
 func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) error {
 	// set priority for selecting tunnel
 	tun.priority = &TSPriority{0, 1e9}
 	p.pool.Push(tun)
 	defer p.onTunDisconnected(tun, handler)
 	tun.SetSockOpt(1, 0, 1)
+	tun.startRekey(p.rekey)
 
 	var (
 		header = make([]byte, FRAME_HEADER_LEN)
 		idle   = NewIdler(interval, p.isClient)
 		router = p.router
+		udpR   = p.udpRouter
 		nr     int
 		er     error
 		frm    *frame
@@ -351,6 +421,9 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 	}
 	for {
 		idle.newRound(tun)
+		if er = idle.checkRekey(tun); er != nil {
+			return er
+		}
 		// read frame header
 		nr, er = io.ReadFull(tun, header)
 		if nr == FRAME_HEADER_LEN {
@@ -380,7 +453,7 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 			return er
 		}
 		// prepare the session key of the frame
-		key = sessionKey(tun, frm.sid)
+		key = streamKey(frm.sid)
 
 		switch frm.action {
 		// stop egress
@@ -393,14 +466,38 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 		case FRAME_ACTION_CLOSE_R:
 			if edge, _ := router.getRegistered(key); edge != nil {
 				edge.bitwiseCompareAndSet(TCP_CLOSE_R)
+				edge.wakeup()
 				closeR(edge.conn)
 			}
 
+		// credit granted by peer
+		case FRAME_ACTION_SLOWDOWN:
+			if edge, _ := router.getRegistered(key); edge != nil && frm.length == 8 {
+				edge.grant(binary.BigEndian.Uint64(frm.data))
+			}
+			frm.free()
+
+		// the client moved the stream to this tun, or the server replied
+		case FRAME_ACTION_MIGRATE:
+			edge, pre := router.getRegistered(key)
+			if edge != nil && frm.length == MIGRATE_BODY_LEN {
+				edge.resume(tun, binary.BigEndian.Uint64(frm.data), binary.BigEndian.Uint64(frm.data[8:]))
+			} else if edge == nil && !pre && !p.isClient {
+				// the stream is gone, then peer should close it
+				pack(header, FRAME_ACTION_CLOSE_R, frm.sid, nil)
+				frameWriteBuffer(tun, header)
+				pack(header, FRAME_ACTION_CLOSE_W, frm.sid, nil)
+				if er = frameWriteBuffer(tun, header); er != nil {
+					return er
+				}
+			}
+			frm.free()
+
 		case FRAME_ACTION_DATA:
 			edge, pre := router.getRegistered(key)
 			if edge != nil {
 				// normally
-				edge.deliver(frm)
+				edge.deliverData(tun, frm)
 			} else if pre {
 				// in fastOpen
 				router.preDeliver(key, frm)
@@ -415,7 +512,7 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 				}
 			}
 
-			// for c/s proxy, this only exist in server side
+			// server side for the client streams, and client side for the reverse streams
 		case FRAME_ACTION_OPEN:
 			router.preRegister(key)
 			// ingress: connect to final destination
@@ -427,6 +524,7 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 				if log.V(log.LV_ACT_FRM) {
 					log.Infoln(p.role, "received OPEN_x", frm)
 				}
+				edge.notifyOpen(frm.action)
 				edge.ready <- frm.action
 				close(edge.ready)
 			} else {
@@ -447,6 +545,7 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 				if p.isClient && idle.lastPing > 0 {
 					sRtt, devRtt := idle.updateRtt()
 					atomic.StoreInt32(&p.sRtt, sRtt)
+					atomic.StoreInt32(&tun.sRtt, sRtt)
 					if DEBUG {
 						log.Infof("sRtt=%d devRtt=%d", sRtt, devRtt)
 						if devRtt+(sRtt>>2) > sRtt {
@@ -462,6 +561,37 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 		case FRAME_ACTION_TOKENS:
 			handler(evt_tokens, frm.data)
 
+		case FRAME_ACTION_REVERSE:
+			handler(evt_reverse, frm.data)
+
+		// the following frames were encrypted by the new key of peer
+		case FRAME_ACTION_REKEY:
+			er = tun.rekeyRead(frm.data)
+			frm.free()
+			if er != nil {
+				return er
+			}
+
+		case FRAME_ACTION_UDP_DATA:
+			udpR.deliver(key, frm, tun)
+
+		case FRAME_ACTION_UDP_CLOSE:
+			udpR.remove(key)
+
+		case FRAME_ACTION_DNS_REQUEST:
+			if p.dns != nil && !p.isClient {
+				go p.dns.exchange(tun, frm)
+			} else {
+				frm.free()
+			}
+
+		case FRAME_ACTION_DNS_REPLY:
+			if p.dns != nil && p.isClient {
+				p.dns.reply(frm)
+			} else {
+				frm.free()
+			}
+
 		default: // impossible
 			return fmt.Errorf("Unrecognized %s", frm)
 		}
@@ -469,15 +599,13 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 	}
 }
 
-func sessionKey(tun *Conn, sid uint16) string {
-	if tun.identifier != NULL {
-		return tun.identifier + "." + strconv.FormatUint(uint64(sid), 10)
-	} else {
-		return fmt.Sprintf("%s_%s_%d", tun.LocalAddr(), tun.RemoteAddr(), sid)
-	}
+// the sid is unique in multiplexer, so the stream could be moved across tuns
+func streamKey(sid uint16) string {
+	return strconv.FormatUint(uint64(sid), 10)
 }
 
 // Server: open a connection to destination by frame
+// Client: open a connection to the target of reverse forwarding
 // then transmit data of dest to the tunnel
 func (p *multiplexer) connectToDest(frm *frame, key string, tun *Conn) {
 	var (
@@ -486,12 +614,21 @@ func (p *multiplexer) connectToDest(frm *frame, key string, tun *Conn) {
 		target  = string(frm.data)
 		denied  = false
 	)
-	if p.filter != nil {
+	if p.isClient {
+		// only the configured targets could be opened by server
+		if target = p.reverse[target]; target == NULL {
+			target, denied = string(frm.data), true
+		}
+	} else if p.filter != nil {
 		// denyDest filter
 		denied = p.filter.Filter(target)
 	}
 	if !denied {
-		dstConn, err = dialer.Dial("tcp", target)
+		if p.dialer != nil {
+			dstConn, err = p.dialer.Dial("tcp", target)
+		} else {
+			dstConn, err = dialer.Dial("tcp", target)
+		}
 	}
 
 	p.sLock.Lock()
@@ -517,11 +654,11 @@ func (p *multiplexer) connectToDest(frm *frame, key string, tun *Conn) {
 
 	} else { // accept and register really
 		dstConn.SetReadDeadline(ZERO_TIME)
-		var edge = p.router.register(key, target, tun, dstConn, false) // write edge
+		var edge = p.router.register(frm.sid, target, tun, dstConn, false) // write edge
 		p.sLock.Unlock()
 
 		if log.V(log.LV_SVR_OPEN) {
-			log.Infoln("OPEN", target, "for", key)
+			log.Infoln("OPEN", target, "for", key, "via", addrFamily(dstConn.RemoteAddr()))
 		}
 
 		// notify peer
@@ -545,27 +682,29 @@ func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 	)
 	defer func() {
 		// actively close then notify peer
+		bytePool.Put(buf)
+		edge.notifyOpen(code)
 		if edge.bitwiseCompareAndSet(TCP_CLOSE_R) && code != FRAME_ACTION_OPEN_DENIED {
-			pack(buf, FRAME_ACTION_CLOSE_W, sid, nil)
-			go func() {
-				// tell peer to closeW
-				frameWriteBuffer(tun, buf[:FRAME_HEADER_LEN])
-				bytePool.Put(buf)
-			}()
-		} else {
-			bytePool.Put(buf)
+			// tell peer to closeW
+			go edge.sendClose()
 		}
 		if code == FRAME_ACTION_OPEN_Y {
 			closeR(src)
 		} else { // remote open failed
 			SafeClose(src)
+			if code == FRAME_ACTION_OPEN_N || code == FRAME_ACTION_OPEN_DENIED {
+				// wakeup the queue to exit then will be cleaned
+				edge.deliver(&frame{action: FRAME_ACTION_CLOSE})
+			}
 		}
 	}()
 
-	// for client
+	// the side opened stream
 	if edge.active {
 		// check blacklist
-		if _, y := p.blacklist.GetNotStale(destHost); y {
+		if p.blacklist == nil {
+			// server: reverse forwarding
+		} else if _, y := p.blacklist.get(destHost); y {
 			code = FRAME_ACTION_OPEN_DENIED
 			if log.V(log.LV_REQ) {
 				log.Infof("Request %s was denied", edge.dest)
@@ -590,7 +729,9 @@ func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 
 		case FRAME_ACTION_OPEN_DENIED:
 			// update blacklist
-			p.blacklist.Set(destHost, true, time.Now().Add(time.Hour))
+			if p.blacklist != nil {
+				p.blacklist.set(destHost, true, time.Now().Add(time.Hour))
+			}
 			if log.V(log.LV_REQ) {
 				log.Infof("Request %s was denied by remote", edge.dest)
 			}
@@ -607,7 +748,7 @@ func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 		tn         int // total
 		nr         int
 		er         error
-		_fast_open = p.isClient
+		_fast_open = edge.active
 		dataBuf    = buf[FRAME_HEADER_LEN:]
 	)
 	for {
@@ -643,17 +784,30 @@ func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 			}
 		}
 
-		nr, er = src.Read(dataBuf)
+		// blocking until peer grants credit
+		var credit = edge.waitCredit()
+		if credit <= 0 {
+			return
+		}
+		if credit > len(dataBuf) {
+			credit = len(dataBuf)
+		}
+		nr, er = src.Read(dataBuf[:credit])
 		if nr > 0 {
 			tn += nr
 			pack(buf, FRAME_ACTION_DATA, sid, uint16(nr))
-			if frameWriteBuffer(tun, buf[:nr+FRAME_HEADER_LEN]) != nil {
-				SafeClose(tun)
-				return
-			}
+			// retained until peer has consumed, then survives the broken tun
+			edge.sendData(buf[:nr+FRAME_HEADER_LEN])
 		}
 		// timeout cause of rechecking then open-signal in fastOpen
 		if er != nil && !(_fast_open && IsTimeout(er)) {
+			// half-closed before the open-signal, it determines closing R or RW
+			if _fast_open && er == io.EOF {
+				select {
+				case code = <-edge.ready:
+				case <-time.After(WAITING_OPEN_TIMEOUT):
+				}
+			}
 			if er != io.EOF && DEBUG {
 				log.Infof("Read to the end of edge total=%d err=(%v)", tn, er)
 			}
@@ -663,9 +817,9 @@ func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 }
 
 // best to send message to peer in some critical cases
-func (p *multiplexer) bestSend(data []byte, action_desc string) bool {
+func (p *multiplexer) bestSend(action byte, data []byte, action_desc string) bool {
 	var buf = make([]byte, FRAME_HEADER_LEN+len(data))
-	pack(buf, FRAME_ACTION_TOKENS, 0, data)
+	pack(buf, action, 0, data)
 
 	for i := 1; i <= 3; i++ {
 		if atomic.LoadInt32(&p.status) < 0 /* MUX_CLOSED */ || p.pool == nil {
@@ -752,15 +906,42 @@ func parse_frame(header []byte) (*frame, error) {
 // range: [1, sid_max)
 func next_sid() uint16 {
 	for {
-		if sid := atomic.AddUint32(&sid_seq, 1); sid < sid_max {
+		sid := atomic.AddUint32(&sid_seq, 1)
+		if sid < sid_max {
 			return uint16(sid)
 		}
-		if atomic.CompareAndSwapUint32(&sid_seq, sid_max, 1) {
+		if atomic.CompareAndSwapUint32(&sid_seq, sid, 1) {
 			return 1
 		}
 	}
 }
 
+// skip the sids still occupied by the streams or udp associations,
+// since the sequence may wrap around while some long-lived ones are open.
+// return 0 if all of them were occupied.
+func (p *multiplexer) allocSid(reverse bool) uint16 {
+	p.sLock.Lock()
+	router, udpR := p.router, p.udpRouter
+	p.sLock.Unlock()
+	for i := uint32(1); i < sid_max; i++ {
+		sid := next_sid()
+		if reverse {
+			sid |= SID_REVERSE
+		}
+		key := streamKey(sid)
+		if router != nil {
+			if e, pre := router.getRegistered(key); e != nil || pre {
+				continue
+			}
+		}
+		if udpR != nil && udpR.get(key) != nil {
+			continue
+		}
+		return sid
+	}
+	return 0
+}
+
 // 0 | 1 | 2-3 | 4-5
 func pack(buf []byte, action byte, sid uint16, body_or_len interface{}) int {
 	var _len uint16
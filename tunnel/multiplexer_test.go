@@ -7,11 +7,13 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"reflect"
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -236,3 +238,137 @@ func TestConcurrency(t *testing.T) {
 	rest(3)
 	checkFinishedLength(t)
 }
+
+func TestFlowControl(t *testing.T) {
+	startEmulation()
+	const total = STREAM_WINDOW * 8
+	ln, e := net.Listen("tcp", "127.0.0.3:0")
+	ThrowErr(e)
+	defer ln.Close()
+	go func() {
+		conn, e := ln.Accept()
+		ThrowErr(e)
+		defer conn.Close()
+		buf := make([]byte, total)
+		conn.Write(buf)
+	}()
+
+	app, peer := net.Pipe()
+	defer app.Close()
+	go client.HandleRequest("T", peer, ln.Addr().String())
+	// the consumer was stalled
+	rest(5)
+	var edge *edgeConn
+	client.router.lock.RLock()
+	for _, e := range client.router.registry {
+		if e.conn == peer {
+			edge = e
+		}
+	}
+	client.router.lock.RUnlock()
+	if edge == nil {
+		t.Fatal("edge was not registered")
+	}
+	edge.queue.lock.Lock()
+	pending := edge.queue.pending
+	edge.queue.lock.Unlock()
+	if pending > STREAM_WINDOW {
+		t.Errorf("queued %d beyond the window", pending)
+	}
+
+	n, e := io.Copy(ioutil.Discard, app)
+	if e != nil || n != total {
+		t.Errorf("received %d error %v", n, e)
+	}
+	app.Close()
+	rest(2)
+	checkFinishedLength(t)
+}
+
+func TestMigration(t *testing.T) {
+	startEmulation()
+	const total = STREAM_WINDOW * 4
+	ln, e := net.Listen("tcp", "127.0.0.3:0")
+	ThrowErr(e)
+	defer ln.Close()
+	go func() {
+		conn, e := ln.Accept()
+		ThrowErr(e)
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	// the surviving tun
+	conn, e := net.Dial("tcp", svrAddr)
+	ThrowErr(e)
+	go client.Listen(NewConn(conn.(*net.TCPConn), nullCipherKit), nil, 0)
+	rest(2)
+	if n := client.pool.Len(); n != 2 {
+		t.Fatalf("client tun size=%d", n)
+	}
+
+	app, peer := net.Pipe()
+	defer app.Close()
+	go client.HandleRequest("T", peer, ln.Addr().String())
+
+	sent := make([]byte, total)
+	rand.Read(sent)
+	go func() {
+		for i := 0; i < total; i += 0x4000 {
+			if _, e := app.Write(sent[i : i+0x4000]); e != nil {
+				return
+			}
+		}
+	}()
+
+	recv := make([]byte, total)
+	_, e = io.ReadFull(app, recv[:total/4])
+	ThrowErr(e)
+	var edge *edgeConn
+	client.router.lock.RLock()
+	for _, e := range client.router.registry {
+		if e.conn == peer {
+			edge = e
+		}
+	}
+	client.router.lock.RUnlock()
+	if edge == nil {
+		t.Fatal("edge was not registered")
+	}
+	// break the tun of stream
+	lost := edge.getTun()
+	lost.Close()
+
+	app.SetReadDeadline(time.Now().Add(MIGRATE_TIMEOUT))
+	_, e = io.ReadFull(app, recv[total/4:])
+	if e != nil {
+		t.Fatal("stream was not resumed", e)
+	}
+	if !bytes.Equal(sent, recv) {
+		t.Errorf("sent is inconsistent with recv")
+	}
+	if tun := edge.getTun(); tun == lost {
+		t.Errorf("stream was not migrated")
+	}
+	app.Close()
+	rest(2)
+	checkFinishedLength(t)
+}
+
+func TestAllocSid(t *testing.T) {
+	mux := newClientMultiplexer()
+	defer mux.destroy()
+	edge, _ := net.Pipe()
+	tun, _ := net.Pipe()
+	mux.router.register(1, "test", NewConn(tun, nullCipherKit), edge, false)
+	last := uint16(sid_max - 1)
+	mux.udpRouter.register(newUdpAssociation(mux.udpRouter, streamKey(last), last, nil, nil))
+
+	// wrap around over the occupied sids
+	atomic.StoreUint32(&sid_seq, sid_max-2)
+	if sid := mux.allocSid(false); sid != 2 {
+		t.Errorf("allocated sid=%d, expected 2", sid)
+	}
+	if sid := mux.allocSid(true); sid != 3|SID_REVERSE {
+		t.Errorf("allocated reverse sid=%#x", sid)
+	}
+}
@@ -0,0 +1,177 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// always bypass the local domains and private ranges
+var (
+	pacLocalDomains = []string{"localhost", "local", "lan", "home.arpa"}
+	pacPrivateCIDRs = []string{
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+	}
+)
+
+// generate /wpad.dat on the fly
+// the content will be cached for each proxy address,
+// and rebuilt after the rules file was modified.
+type pacGenerator struct {
+	lock      sync.Mutex
+	rulesFile string
+	modTime   time.Time
+	withSocks bool // socks can't carry proxy authentication
+	cache     map[string][]byte
+}
+
+func newPacGenerator(rulesFile string, withSocks bool) *pacGenerator {
+	return &pacGenerator{
+		rulesFile: rulesFile,
+		withSocks: withSocks,
+		cache:     make(map[string][]byte),
+	}
+}
+
+// proxyAddr: the local address which the browser has reached
+func (g *pacGenerator) generate(proxyAddr string) ([]byte, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.rulesFile != NULL {
+		info, err := os.Stat(g.rulesFile)
+		if err != nil {
+			return nil, err
+		}
+		if !info.ModTime().Equal(g.modTime) {
+			g.modTime = info.ModTime()
+			g.cache = make(map[string][]byte)
+		}
+	}
+	if content := g.cache[proxyAddr]; content != nil {
+		return content, nil
+	}
+
+	var rules *RuleSet
+	if g.rulesFile != NULL {
+		var err error
+		if rules, err = LoadRuleSet(g.rulesFile); err != nil {
+			return nil, err
+		}
+	}
+	var proxy = "PROXY " + proxyAddr
+	if g.withSocks {
+		proxy = "SOCKS5 " + proxyAddr + "; " + proxy
+	}
+	content := buildPAC(proxy, rules)
+	g.cache[proxyAddr] = content
+	return content, nil
+}
+
+func buildPAC(proxy string, rules *RuleSet) []byte {
+	var buf = new(bytes.Buffer)
+	fmt.Fprintf(buf, "// Generated by deblocus %s at %s\n", VER_STRING, time.Now().Format(time.RFC3339))
+	fmt.Fprintf(buf, "var proxy = %q;\n", proxy)
+	fmt.Fprint(buf, "var rules = [\n")
+	for _, d := range pacLocalDomains {
+		fmt.Fprintf(buf, "\t[\"suffix\", %q, 1],\n", d)
+	}
+	for _, c := range pacPrivateCIDRs {
+		ip, mask, _ := pacNetOf(c)
+		fmt.Fprintf(buf, "\t[\"lan\", %q, %q, 1],\n", ip, mask)
+	}
+
+	var final = RULE_PROXY
+	if rules != nil {
+		final = rules.final
+		for _, r := range rules.rules {
+			var direct = 0
+			if r.action == RULE_DIRECT {
+				direct = 1
+			}
+			switch r.kind {
+			case RULE_DOMAIN_SUFFIX:
+				fmt.Fprintf(buf, "\t[\"suffix\", %q, %d],\n", r.pattern, direct)
+				continue
+			case RULE_DOMAIN_KEYWORD:
+				fmt.Fprintf(buf, "\t[\"keyword\", %q, %d],\n", r.pattern, direct)
+				continue
+			case RULE_IP_CIDR:
+				if ip, mask, y := pacNetOf(r.value); y {
+					fmt.Fprintf(buf, "\t[\"cidr\", %q, %q, %d],\n", ip, mask, direct)
+					continue
+				}
+			}
+			// inexpressible in PAC, then the client decides.
+			// skipping a DIRECT rule is harmless,
+			// but others may precede the following DIRECT rules.
+			if r.action != RULE_DIRECT {
+				final = RULE_PROXY
+				break
+			}
+		}
+	}
+	fmt.Fprint(buf, "];\n")
+	if final == RULE_DIRECT {
+		fmt.Fprint(buf, "var finalDirect = 1;\n")
+	} else {
+		fmt.Fprint(buf, "var finalDirect = 0;\n")
+	}
+	fmt.Fprint(buf, _PAC_FUNCTION)
+	return buf.Bytes()
+}
+
+// ipv4 cidr to ip and mask
+func pacNetOf(cidr string) (string, string, bool) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil || ipNet.IP.To4() == nil || len(ipNet.Mask) != net.IPv4len {
+		return NULL, NULL, false
+	}
+	m := ipNet.Mask
+	mask := strconv.Itoa(int(m[0])) + "." + strconv.Itoa(int(m[1])) + "." +
+		strconv.Itoa(int(m[2])) + "." + strconv.Itoa(int(m[3]))
+	return ipNet.IP.String(), mask, true
+}
+
+const _PAC_FUNCTION = `
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (isPlainHostName(host)) {
+		return "DIRECT";
+	}
+	var isIP = /^\d+\.\d+\.\d+\.\d+$/.test(host);
+	var ip = isIP ? host : null;
+	for (var i = 0; i < rules.length; i++) {
+		var r = rules[i], matched = false;
+		switch (r[0]) {
+		case "suffix":
+			matched = !isIP && (host == r[1] || dnsDomainIs(host, "." + r[1]));
+			break;
+		case "keyword":
+			matched = !isIP && host.indexOf(r[1]) >= 0;
+			break;
+		case "lan":
+			matched = isIP && isInNet(ip, r[1], r[2]);
+			break;
+		case "cidr":
+			if (ip == null) {
+				ip = dnsResolve(host) || "";
+			}
+			matched = ip != "" && isInNet(ip, r[1], r[2]);
+			break;
+		}
+		if (matched) {
+			return r[r.length - 1] ? "DIRECT" : proxy;
+		}
+	}
+	return finalDirect ? "DIRECT" : proxy;
+}
+`
@@ -0,0 +1,83 @@
+package tunnel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildPAC(t *testing.T) {
+	set, err := parseRuleSet(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pac := string(buildPAC("PROXY 127.0.0.1:9009", set))
+	for _, expected := range []string{
+		`var proxy = "PROXY 127.0.0.1:9009";`,
+		`["suffix", "home.arpa", 1]`,
+		`["lan", "192.168.0.0", "255.255.0.0", 1]`,
+		`["suffix", "example.com", 1]`,
+		`["keyword", "ads", 0]`,
+		`["cidr", "10.0.0.0", "255.0.0.0", 1]`,
+		`var finalDirect = 0;`,
+		`function FindProxyForURL`,
+	} {
+		if !strings.Contains(pac, expected) {
+			t.Errorf("PAC should contain %s", expected)
+		}
+	}
+
+	// the rules following an inexpressible non-DIRECT rule are left to client
+	set, _ = parseRuleSet(strings.NewReader("PORT,25,REJECT\nDOMAIN-SUFFIX,example.com,DIRECT\nFINAL,DIRECT"))
+	pac = string(buildPAC("PROXY 127.0.0.1:9009", set))
+	if strings.Contains(pac, `"example.com"`) || !strings.Contains(pac, `var finalDirect = 0;`) {
+		t.Errorf("PAC should be truncated\n%s", pac)
+	}
+
+	// the same normalized values as the client matches
+	set, _ = parseRuleSet(strings.NewReader("DOMAIN-SUFFIX,.Example.COM,DIRECT\nDOMAIN-KEYWORD,AdS,REJECT"))
+	pac = string(buildPAC("PROXY 127.0.0.1:9009", set))
+	if !strings.Contains(pac, `["suffix", "example.com", 1]`) || !strings.Contains(pac, `["keyword", "ads", 0]`) {
+		t.Errorf("PAC should be normalized\n%s", pac)
+	}
+}
+
+func TestPacGeneratorCache(t *testing.T) {
+	file, err := ioutil.TempFile(NULL, "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("DOMAIN-SUFFIX,example.com,DIRECT\n")
+	file.Close()
+
+	g := newPacGenerator(file.Name(), true)
+	a, err := g.generate("127.0.0.1:9009")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(a, []byte(`"SOCKS5 127.0.0.1:9009; PROXY 127.0.0.1:9009"`)) {
+		t.Errorf("Unexpected proxy\n%s", a)
+	}
+	b, _ := g.generate("127.0.0.1:9009")
+	if &a[0] != &b[0] {
+		t.Errorf("PAC should be cached")
+	}
+	c, _ := g.generate("192.168.1.2:9009")
+	if !bytes.Contains(c, []byte(`PROXY 192.168.1.2:9009"`)) {
+		t.Errorf("PAC should follow the listen address")
+	}
+
+	ioutil.WriteFile(file.Name(), []byte("DOMAIN-SUFFIX,example.org,DIRECT\n"), 0644)
+	os.Chtimes(file.Name(), time.Now(), time.Now().Add(time.Minute))
+	b, err = g.generate("127.0.0.1:9009")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(`"example.org"`)) || bytes.Contains(b, []byte(`"example.com"`)) {
+		t.Errorf("PAC should be rebuilt\n%s", b)
+	}
+}
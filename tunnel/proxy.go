@@ -3,6 +3,7 @@ package tunnel
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -17,6 +18,7 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/Lafeng/deblocus/auth"
 	"github.com/Lafeng/deblocus/exception"
 	log "github.com/Lafeng/deblocus/glog"
 )
@@ -29,29 +31,48 @@ const (
 	S5_VER byte = 5
 )
 
+const (
+	SOCKS_CMD_CONNECT   byte = 1
+	SOCKS_CMD_UDP_ASSOC byte = 3
+)
+
+const (
+	SOCKS_AUTH_NONE     byte = 0
+	SOCKS_AUTH_PASSWD   byte = 2
+	SOCKS_AUTH_PASS_VER byte = 1
+)
+
 const (
 	PROT_UNKNOWN = 1
 	PROT_SOCKS5  = 2
 	PROT_HTTP    = 3
 	PROT_HTTP_T  = 4
 	PROT_LOCAL   = 5
+	PROT_SOCKS4  = 6
 )
 
 const (
 	HTTP_PROXY_STATUS_LINE = "HTTP/1.1 200 Connection established"
+	HTTP_PROXY_AUTH_LINE   = "HTTP/1.1 407 Proxy Authentication Required"
+	HTTP_PROXY_AUTH_REALM  = "Proxy-Authenticate: Basic realm=\"deblocus\""
 	CRLF                   = "\r\n"
 )
 
 var (
 	// socks5 exceptions
 	INVALID_SOCKS5_HEADER = exception.New("Invalid socks5 header")
+	INVALID_SOCKS4_HEADER = exception.New("Invalid socks4 header")
 	HOST_UNREACHABLE      = exception.New("Host is unreachable")
+	PROXY_AUTH_FAILED     = exception.New("Proxy authentication failed")
+	PROXY_AUTH_REQUIRED   = exception.New("Proxy authentication required")
 )
 
 // socks5 protocol handler in client side
 // Ref: https://www.ietf.org/rfc/rfc1928.txt
+// auth: require username/password authentication if it was non-nil
 type socks5Handler struct {
 	conn net.Conn
+	auth auth.AuthSys
 }
 
 // step1-2
@@ -82,16 +103,28 @@ func (s socks5Handler) handshake() bool {
 		goto errHandler
 	}
 
+	if s.auth != nil {
+		if bytes.IndexByte(buf[:nmethods], SOCKS_AUTH_PASSWD) < 0 {
+			err = PROXY_AUTH_REQUIRED
+			exception.Spawn(&err, "socks: methods [% x]", buf[:nmethods])
+			goto errHandler
+		}
+		buf = []byte{5, SOCKS_AUTH_PASSWD}
+	} else {
+		buf = []byte{5, SOCKS_AUTH_NONE}
+	}
+
 	// accept
-	buf = []byte{5, 0}
 	setWTimeout(s.conn)
 	_, err = s.conn.Write(buf)
-	if err == nil {
-		return true
-	} else {
+	if err != nil {
 		err = exception.Spawn(&err, "socks: write response")
 		goto errLogging
 	}
+	if s.auth != nil {
+		return s.authenticate()
+	}
+	return true
 
 errHandler:
 	// handshake error feedback
@@ -104,68 +137,307 @@ errLogging:
 	return false
 }
 
+// username/password subnegotiation
+// Ref: https://www.ietf.org/rfc/rfc1929.txt
+// VER~1 | ULEN~1 | UNAME~ULEN | PLEN~1 | PASSWD~PLEN
+func (s socks5Handler) authenticate() bool {
+	var (
+		buf          = make([]byte, 0xff)
+		user, passwd string
+		ok           bool
+	)
+	setRTimeout(s.conn)
+	_, err := io.ReadFull(s.conn, buf[:2])
+	if err != nil {
+		exception.Spawn(&err, "socks: read auth")
+		goto errLogging
+	}
+	if buf[0] != SOCKS_AUTH_PASS_VER {
+		err = INVALID_SOCKS5_HEADER
+		exception.Spawn(&err, "socks: auth version %d", buf[0])
+		goto errHandler
+	}
+	if user, err = s.readField(int(buf[1])); err != nil {
+		goto errHandler
+	}
+	if _, err = io.ReadFull(s.conn, buf[:1]); err != nil {
+		exception.Spawn(&err, "socks: read auth")
+		goto errHandler
+	}
+	if passwd, err = s.readField(int(buf[0])); err != nil {
+		goto errHandler
+	}
+
+	ok, err = s.auth.Authenticate(user, passwd)
+	if !ok {
+		if err == nil {
+			err = PROXY_AUTH_FAILED
+		}
+		exception.Spawn(&err, "socks: auth %s", user)
+		goto errHandler
+	}
+	// success
+	setWTimeout(s.conn)
+	_, err = s.conn.Write([]byte{SOCKS_AUTH_PASS_VER, 0})
+	if err == nil {
+		return true
+	}
+	exception.Spawn(&err, "socks: write auth response")
+	goto errLogging
+
+errHandler:
+	setWTimeout(s.conn)
+	s.conn.Write([]byte{SOCKS_AUTH_PASS_VER, 1})
+errLogging:
+	log.Warningln(err)
+	return false
+}
+
+func (s socks5Handler) readField(size int) (string, error) {
+	var buf = make([]byte, size)
+	_, err := io.ReadFull(s.conn, buf)
+	if err != nil {
+		return NULL, exception.Spawn(&err, "socks: read auth")
+	}
+	return string(buf), nil
+}
+
 // step3-4
-func (s socks5Handler) readRequest() (string, bool) {
+// reply for CONNECT, UDP ASSOCIATE will be replied by udpAssociate()
+func (s socks5Handler) readRequest() (cmd byte, host string, ok bool) {
 	var (
-		buf            = make([]byte, 262) // 4+(1+255)+2
-		host           string
-		ofs            int
-		ver, cmd, atyp byte
+		buf = make([]byte, 262) // 4+(1+255)+2
+		n   int
+		ver byte
 	)
 	var msg = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
 	setRTimeout(s.conn)
-	_, err := s.conn.Read(buf)
+	n, err := s.conn.Read(buf)
 	if err != nil {
 		exception.Spawn(&err, "socks: read request")
 		goto errLogging
 	}
-	ver, cmd, atyp = buf[0], buf[1], buf[3]
-	if ver != S5_VER || cmd != 1 {
+	if n < 4 {
+		err = INVALID_SOCKS5_HEADER
+		exception.Spawn(&err, "socks: invalid request")
+		goto errHandler
+	}
+	ver, cmd = buf[0], buf[1]
+	if ver != S5_VER || (cmd != SOCKS_CMD_CONNECT && cmd != SOCKS_CMD_UDP_ASSOC) {
+		err = INVALID_SOCKS5_HEADER
+		exception.Spawn(&err, "socks: unsupported command %d", cmd)
+		msg[1] = 0x7 // command not supported
+		goto errReply
+	}
+
+	host, _, err = parseSocksAddr(buf[3:n])
+	if err != nil {
 		exception.Spawn(&err, "socks: invalid request")
 		goto errHandler
 	}
 
-	buf = buf[4:]
-	switch atyp {
+	if cmd == SOCKS_CMD_CONNECT {
+		// accept
+		_, err = s.conn.Write(msg)
+		if err != nil {
+			exception.Spawn(&err, "socks: write response")
+			goto errLogging
+		}
+	}
+	return cmd, host, true
+
+errHandler:
+	msg[1] = 0x1 // general SOCKS server failure
+errReply:
+	setWTimeout(s.conn)
+	s.conn.Write(msg)
+errLogging:
+	log.Warningln(err)
+
+	return 0, NULL, false
+}
+
+// bind a local udp relay for UDP ASSOCIATE then reply the bound address
+func (s socks5Handler) udpAssociate() (*net.UDPConn, bool) {
+	var ip net.IP
+	if addr, y := s.conn.LocalAddr().(*net.TCPAddr); y {
+		ip = addr.IP
+	}
+	var msg = []byte{5, 0, 0}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		exception.Spawn(&err, "socks: bind udp relay")
+		msg[1] = 0x1 // general SOCKS server failure
+		msg = append(msg, IPV4, 0, 0, 0, 0, 0, 0)
+	} else {
+		msg = append(msg, socksAddrOf(relay.LocalAddr().(*net.UDPAddr))...)
+	}
+
+	setWTimeout(s.conn)
+	_, ew := s.conn.Write(msg)
+	if err == nil && ew != nil {
+		err = ew
+		exception.Spawn(&err, "socks: write response")
+		relay.Close()
+	}
+	if err != nil {
+		log.Warningln(err)
+		return nil, false
+	}
+	return relay, true
+}
+
+// parse ATYP|DST.ADDR|DST.PORT
+// return the literal host:port and the consumed length
+func parseSocksAddr(buf []byte) (host string, n int, err error) {
+	if len(buf) < 1 {
+		return NULL, 0, INVALID_SOCKS5_HEADER
+	}
+	switch buf[0] {
 	case IPV4:
-		host = net.IP(buf[:net.IPv4len]).String()
-		ofs = net.IPv4len
+		n = 1 + net.IPv4len
+		if len(buf) >= n+2 {
+			host = net.IP(buf[1:n]).String()
+		}
 	case IPV6:
-		host = "[" + net.IP(buf[:net.IPv6len]).String() + "]"
-		ofs = net.IPv6len
+		n = 1 + net.IPv6len
+		if len(buf) >= n+2 {
+			host = "[" + net.IP(buf[1:n]).String() + "]"
+		}
 	case DOMAIN:
-		dlen := int(buf[0])
-		ofs = dlen + 1
-		host = string(buf[1:ofs])
+		if len(buf) > 1 {
+			n = int(buf[1]) + 2
+		}
+		if n > 2 && len(buf) >= n+2 {
+			host = string(buf[2:n])
+			// literal IPv6
+			if strings.Count(host, ":") >= 2 && !strings.HasPrefix(host, "[") {
+				host = "[" + host + "]"
+			}
+		}
+	}
+	if host == NULL {
+		return NULL, 0, INVALID_SOCKS5_HEADER
+	}
+	host += ":" + strconv.Itoa(int(binary.BigEndian.Uint16(buf[n:])))
+	return host, n + 2, nil
+}
+
+// build ATYP|ADDR|PORT of the udp address
+func socksAddrOf(addr *net.UDPAddr) []byte {
+	var buf []byte
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		buf = make([]byte, 1+net.IPv4len+2)
+		buf[0] = IPV4
+		copy(buf[1:], ip4)
+	} else {
+		buf = make([]byte, 1+net.IPv6len+2)
+		buf[0] = IPV6
+		copy(buf[1:], addr.IP.To16())
+	}
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(addr.Port))
+	return buf
+}
+
+// socks4 and socks4a protocol handler in client side
+// Ref: http://www.openssh.com/txt/socks4.protocol
+//
+//	http://www.openssh.com/txt/socks4a.protocol
+//
+// socks4 carries no password, so it will be rejected if auth was non-nil.
+type socks4Handler struct {
+	conn net.Conn
+	auth auth.AuthSys
+}
+
+// VN~1 | CD~1 | DSTPORT~2 | DSTIP~4 | USERID~? | NULL | [DOMAIN~? | NULL]
+func (s socks4Handler) readRequest() (string, bool) {
+	var (
+		buf      = make([]byte, 8)
+		host     string
+		port     uint16
+		ver, cmd byte
+		ip       net.IP
+		domain   []byte
+		err      error
+	)
+	// reply: VN=0 | CD | DSTPORT | DSTIP
+	var msg = []byte{0, 90, 0, 0, 0, 0, 0, 0}
+	setRTimeout(s.conn)
+	_, err = io.ReadFull(s.conn, buf)
+	if err != nil {
+		exception.Spawn(&err, "socks4: read request")
+		goto errLogging
+	}
+	ver, cmd = buf[0], buf[1]
+	if ver != S4_VER || cmd != SOCKS_CMD_CONNECT {
+		err = INVALID_SOCKS4_HEADER
+		exception.Spawn(&err, "socks4: unsupported command %d", cmd)
+		goto errHandler
+	}
+	if s.auth != nil {
+		err = PROXY_AUTH_REQUIRED
+		exception.Spawn(&err, "socks4: request")
+		goto errHandler
+	}
+	port = binary.BigEndian.Uint16(buf[2:])
+	ip = net.IP(buf[4:8])
+
+	// discard userid
+	if _, err = s.readString(); err != nil {
+		goto errHandler
+	}
+	// socks4a: DSTIP=0.0.0.x (x != 0) followed by domain
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if domain, err = s.readString(); err != nil || len(domain) == 0 {
+			err = INVALID_SOCKS4_HEADER
+			exception.Spawn(&err, "socks4a: invalid domain")
+			goto errHandler
+		}
+		host = string(domain)
 		// literal IPv6
 		if strings.Count(host, ":") >= 2 && !strings.HasPrefix(host, "[") {
 			host = "[" + host + "]"
 		}
-	default:
-		exception.Spawn(&err, "socks: invalid request")
-		goto errHandler
+	} else {
+		host = ip.String()
 	}
 
 	// accept
+	setWTimeout(s.conn)
 	_, err = s.conn.Write(msg)
 	if err != nil {
-		exception.Spawn(&err, "socks: write response")
+		exception.Spawn(&err, "socks4: write response")
 		goto errLogging
 	}
-
-	host += ":" + strconv.Itoa(int(binary.BigEndian.Uint16(buf[ofs:])))
+	host += ":" + strconv.Itoa(int(port))
 	return host, true
 
 errHandler:
-	msg[1] = 0x1 // general SOCKS server failure
+	msg[1] = 91 // request rejected or failed
 	setWTimeout(s.conn)
 	s.conn.Write(msg)
 errLogging:
 	log.Warningln(err)
-
 	return NULL, false
 }
 
+// read a NULL terminated string of limited length
+func (s socks4Handler) readString() ([]byte, error) {
+	var str = make([]byte, 0, 16)
+	var b = make([]byte, 1)
+	for len(str) <= 0xff {
+		if _, err := io.ReadFull(s.conn, b); err != nil {
+			return nil, exception.Spawn(&err, "socks4: read request")
+		}
+		if b[0] == 0 {
+			return str, nil
+		}
+		str = append(str, b[0])
+	}
+	return nil, INVALID_SOCKS4_HEADER
+}
+
 // determines protocol of client req
 func detectProtocol(pbconn *pushbackInputStream) (int, error) {
 	var b = make([]byte, 2)
@@ -187,13 +459,14 @@ func detectProtocol(pbconn *pushbackInputStream) (int, error) {
 	case head >= 'A' && head <= 'z':
 		return PROT_HTTP, nil
 	case head == 4: // socks4, socks4a
-		return PROT_UNKNOWN, nil
+		return PROT_SOCKS4, nil
 	default:
 		return PROT_UNKNOWN, nil
 	}
 }
 
-func httpProxyHandshake(conn *pushbackInputStream) (proto int, target string, err error) {
+// authSys: verify the Proxy-Authorization of proxy requests if it was non-nil
+func httpProxyHandshake(conn *pushbackInputStream, authSys auth.AuthSys) (proto int, target string, err error) {
 	var req *http.Request
 	reader := bufio.NewReader(conn)
 	setRTimeout(conn)
@@ -202,6 +475,16 @@ func httpProxyHandshake(conn *pushbackInputStream) (proto int, target string, er
 		return
 	}
 
+	// local static request is exempt from authentication
+	// req.RequestURI.length >= 1
+	if authSys != nil && !(req.Method == "GET" && req.RequestURI[0] == '/') {
+		err = httpProxyAuthenticate(authSys, req)
+		if err != nil {
+			writeProxyAuthRequired(conn)
+			return
+		}
+	}
+
 	// http tunnel, direct into tunnel
 	if req.Method == "CONNECT" {
 		proto = PROT_HTTP_T
@@ -227,40 +510,83 @@ func httpProxyHandshake(conn *pushbackInputStream) (proto int, target string, er
 			proto = PROT_HTTP
 			target = req.Host
 
-			// delete http header Proxy-xxx
-			for k, _ := range req.Header {
-				if strings.HasPrefix(k, "Proxy") {
-					delete(req.Header, k)
-				}
-			}
+			stripProxyHeaders(req)
 			buf := new(bytes.Buffer)
 			// serialize modified request to buffer
 			req.Write(buf)
-			// rollback
+			// rollback, and the pipelined requests
 			conn.Unread(buf.Bytes())
+			if n := reader.Buffered(); n > 0 {
+				remains, _ := reader.Peek(n)
+				conn.Unread(remains)
+			}
 		}
 	}
 
-	if target == NULL {
-		err = errors.New("missing host in address")
-		return
+	if req.Method == "CONNECT" {
+		target, err = httpTargetOf(target, "443")
+	} else {
+		target, err = httpTargetOf(target, "80")
 	}
+	return
+}
 
-	_, _, err = net.SplitHostPort(target)
+// the header.Host may be without port
+func httpTargetOf(host, defaultPort string) (string, error) {
+	if host == NULL {
+		return NULL, errors.New("missing host in address")
+	}
+	_, _, err := net.SplitHostPort(host)
 	if err != nil {
-		// plain http request: the header.Host without port
 		if strings.Contains(err.Error(), "missing port") {
-			err = nil
-			if req.Method == "CONNECT" {
-				target += ":443"
-			} else {
-				target += ":80"
-			}
-		} else {
-			return
+			return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort), nil
+		}
+		return NULL, err
+	}
+	return host, nil
+}
+
+// delete http header Proxy-xxx
+func stripProxyHeaders(req *http.Request) {
+	for k, _ := range req.Header {
+		if strings.HasPrefix(k, "Proxy") {
+			delete(req.Header, k)
 		}
 	}
-	return
+}
+
+func writeProxyAuthRequired(conn net.Conn) {
+	setWTimeout(conn)
+	fmt.Fprint(conn, HTTP_PROXY_AUTH_LINE, CRLF, HTTP_PROXY_AUTH_REALM, CRLF,
+		"Content-Length: 0", CRLF, "Connection: close", CRLF, CRLF)
+}
+
+// Proxy-Authorization: Basic base64(user:passwd)
+// Ref: https://tools.ietf.org/html/rfc7617
+func httpProxyAuthenticate(authSys auth.AuthSys, req *http.Request) error {
+	var credential string
+	var value = req.Header.Get("Proxy-Authorization")
+	if value == NULL {
+		return PROXY_AUTH_REQUIRED
+	}
+	if len(value) > 6 && strings.EqualFold(value[:6], "Basic ") {
+		if b, e := base64.StdEncoding.DecodeString(strings.TrimSpace(value[6:])); e == nil {
+			credential = string(b)
+		}
+	}
+	pos := strings.IndexByte(credential, ':')
+	if pos < 0 {
+		return PROXY_AUTH_FAILED.Apply("invalid credential")
+	}
+	user := credential[:pos]
+	ok, err := authSys.Authenticate(user, credential[pos+1:])
+	if !ok {
+		if err == nil {
+			err = PROXY_AUTH_FAILED
+		}
+		return exception.Spawn(&err, "http: auth %s", user)
+	}
+	return nil
 }
 
 func openReadOnlyFile(file string) (f *os.File, info os.FileInfo, err error) {
@@ -277,8 +603,22 @@ func (c *Client) localServlet(conn net.Conn, reqUri string) {
 
 	switch reqUri {
 	case "/wpad.dat":
-		if c.connInfo.pacFile != NULL { // has pac setting
-			pacFile, info, err := openReadOnlyFile(c.connInfo.pacFile)
+		if c.pac != nil { // generate automatically
+			content, err := c.pac.generate(conn.LocalAddr().String())
+			if err != nil {
+				log.Errorln("Generate PAC", err)
+				goto error404
+			}
+			entity := respEntity{
+				contentType:   "application/x-ns-proxy-autoconfig",
+				contentLength: len(content),
+				stream:        bytes.NewReader(content),
+			}
+			writeHttpResponse(conn, 200, &entity)
+			return
+		}
+		if c.pacFile != NULL { // has pac setting
+			pacFile, info, err := openReadOnlyFile(c.pacFile)
 			if err != nil {
 				log.Errorln("Read PAC file", err)
 				goto error404
@@ -385,18 +725,16 @@ type mainPageData struct {
 }
 
 func buildMainPageData(c *Client) interface{} {
-	var rtt int32
-	if c.mux != nil {
-		rtt = atomic.LoadInt32(&c.mux.sRtt)
-	}
+	// the server which serves new requests currently
+	var r = c.selectRemote()
 	data := mainPageData{
 		Version:    VER_STRING,
 		StartTime:  startTime,
 		ReqCount:   atomic.LoadInt32(&c.reqCnt),
-		Round:      atomic.LoadInt32(&c.round),
+		Round:      r.sm.round(),
 		Ready:      c.IsReady(),
-		AvgRtt:     rtt,
-		Connection: c.connInfo.rawURL,
+		AvgRtt:     atomic.LoadInt32(&r.getMux().sRtt),
+		Connection: r.connInfo.rawURL,
 	}
 	if data.Round > 0 {
 		data.Round--
@@ -0,0 +1,174 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/Lafeng/deblocus/auth"
+)
+
+func socks4Request(t *testing.T, req []byte) (string, bool, []byte) {
+	clt, svr := net.Pipe()
+	defer clt.Close()
+	defer svr.Close()
+	var reply = make([]byte, 8)
+	var done = make(chan bool)
+	go clt.Write(req)
+	go func() {
+		io.ReadFull(clt, reply)
+		close(done)
+	}()
+	host, ok := socks4Handler{svr, nil}.readRequest()
+	<-done
+	return host, ok, reply
+}
+
+func TestSocks4Request(t *testing.T) {
+	// CONNECT 10.1.2.3:8080 with userid
+	req := []byte{4, 1, 0x1f, 0x90, 10, 1, 2, 3, 'u', 's', 'e', 'r', 0}
+	host, ok, reply := socks4Request(t, req)
+	if !ok || host != "10.1.2.3:8080" {
+		t.Errorf("socks4 host=%s ok=%v", host, ok)
+	}
+	if !bytes.Equal(reply[:2], []byte{0, 90}) {
+		t.Errorf("socks4 reply=[% x]", reply)
+	}
+
+	// socks4a CONNECT example.com:443 without userid
+	req = []byte{4, 1, 0x1, 0xbb, 0, 0, 0, 1, 0}
+	req = append(req, "example.com"...)
+	req = append(req, 0)
+	host, ok, _ = socks4Request(t, req)
+	if !ok || host != "example.com:443" {
+		t.Errorf("socks4a host=%s ok=%v", host, ok)
+	}
+
+	// BIND is unsupported
+	req = []byte{4, 2, 0, 80, 10, 1, 2, 3, 0}
+	host, ok, reply = socks4Request(t, req)
+	if ok || reply[1] != 91 {
+		t.Errorf("socks4 bind ok=%v reply=[% x]", ok, reply)
+	}
+}
+
+type testAuthSys map[string]string
+
+func (a testAuthSys) Authenticate(user, passwd string) (bool, error) {
+	if p, y := a[user]; y && p == passwd {
+		return true, nil
+	}
+	return false, auth.AUTH_FAILED
+}
+
+func (a testAuthSys) AddUser(user *auth.User) error {
+	return nil
+}
+
+func (a testAuthSys) UserInfo(user string) (*auth.User, error) {
+	return &auth.User{Name: user, Pass: a[user]}, nil
+}
+
+// the client sends the subnegotiation after the method was selected
+func socks5Handshake(authSys auth.AuthSys, greeting, subneg []byte) (bool, []byte) {
+	clt, svr := net.Pipe()
+	defer clt.Close()
+	defer svr.Close()
+	var reply = make([]byte, 2, 4)
+	var done = make(chan bool)
+	go func() {
+		defer close(done)
+		clt.Write(greeting)
+		io.ReadFull(clt, reply)
+		if reply[1] == SOCKS_AUTH_PASSWD {
+			reply = reply[:4]
+			clt.Write(subneg)
+			io.ReadFull(clt, reply[2:])
+		}
+	}()
+	ok := socks5Handler{svr, authSys}.handshake()
+	svr.Close()
+	<-done
+	return ok, reply
+}
+
+func TestSocks5Authentication(t *testing.T) {
+	var authSys = testAuthSys{"user": "pass"}
+	// no authentication required
+	ok, reply := socks5Handshake(nil, []byte{5, 1, 0}, nil)
+	if !ok || !bytes.Equal(reply, []byte{5, 0}) {
+		t.Errorf("no-auth ok=%v reply=[% x]", ok, reply)
+	}
+
+	// client doesn't offer username/password
+	ok, reply = socks5Handshake(authSys, []byte{5, 1, 0}, nil)
+	if ok || !bytes.Equal(reply, []byte{5, 0xff}) {
+		t.Errorf("no-method ok=%v reply=[% x]", ok, reply)
+	}
+
+	subneg := []byte{1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'}
+	ok, reply = socks5Handshake(authSys, []byte{5, 2, 0, 2}, subneg)
+	if !ok || !bytes.Equal(reply, []byte{5, 2, 1, 0}) {
+		t.Errorf("auth ok=%v reply=[% x]", ok, reply)
+	}
+
+	subneg = []byte{1, 4, 'u', 's', 'e', 'r', 3, 'b', 'a', 'd'}
+	ok, reply = socks5Handshake(authSys, []byte{5, 1, 2}, subneg)
+	if ok || !bytes.Equal(reply, []byte{5, 2, 1, 1}) {
+		t.Errorf("bad-auth ok=%v reply=[% x]", ok, reply)
+	}
+}
+
+func httpHandshake(authSys auth.AuthSys, req string) (int, error, *http.Response) {
+	clt, svr := net.Pipe()
+	defer clt.Close()
+	defer svr.Close()
+	var resp *http.Response
+	var done = make(chan bool)
+	go clt.Write([]byte(req))
+	go func() {
+		resp, _ = http.ReadResponse(bufio.NewReader(clt), nil)
+		close(done)
+	}()
+	proto, _, err := httpProxyHandshake(NewPushbackInputStream(svr), authSys)
+	svr.Close()
+	<-done
+	return proto, err, resp
+}
+
+func TestHttpProxyAuthentication(t *testing.T) {
+	var authSys = testAuthSys{"user": "pass"}
+	// dXNlcjpwYXNz = user:pass
+	req := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n" +
+		"Proxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n"
+	proto, err, resp := httpHandshake(authSys, req)
+	if err != nil || proto != PROT_HTTP_T || resp == nil || resp.StatusCode != 200 {
+		t.Errorf("auth proto=%d err=%v resp=%v", proto, err, resp)
+	}
+
+	req = "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"
+	_, err, resp = httpHandshake(authSys, req)
+	if err == nil || resp == nil || resp.StatusCode != 407 {
+		t.Errorf("no-auth err=%v resp=%v", err, resp)
+	} else if resp.Header.Get("Proxy-Authenticate") == NULL {
+		t.Errorf("missing Proxy-Authenticate")
+	}
+
+	// dXNlcjpiYWQ= = user:bad
+	req = "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n" +
+		"Proxy-Authorization: Basic dXNlcjpiYWQ=\r\n\r\n"
+	_, err, resp = httpHandshake(authSys, req)
+	if err == nil || resp == nil || resp.StatusCode != 407 {
+		t.Errorf("bad-auth err=%v resp=%v", err, resp)
+	}
+
+	// local request is exempt
+	req = "GET /wpad.dat HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	proto, err, _ = httpHandshake(authSys, req)
+	if err != nil || proto != PROT_LOCAL {
+		t.Errorf("local proto=%d err=%v", proto, err)
+	}
+}
@@ -2,8 +2,8 @@ package tunnel
 
 import (
 	"container/list"
+	"encoding/binary"
 	"net"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,25 +29,44 @@ const (
 )
 
 type edgeConn struct {
-	mux    *multiplexer
-	tun    *Conn
-	conn   net.Conn
-	ready  chan byte // peer status
-	key    string
-	dest   string
-	queue  *equeue
-	active bool // actively open
-	closed uint32
-}
-
-func newEdgeConn(mux *multiplexer, key, dest string, tun *Conn, conn net.Conn) *edgeConn {
+	mux      *multiplexer
+	tun      *Conn // current tun, may be changed by migration
+	conn     net.Conn
+	ready    chan byte // peer status
+	opened   chan<- error
+	key      string
+	sid      uint16
+	dest     string
+	queue    *equeue
+	active   bool // actively open
+	closed   uint32
+	credit   *sync.Cond // credit granted, with lock
+	// lock: tun, sent, acked, retrans, opened
+	// wlock: writing to tun, suspended, migrated, finished, epoch
+	lock      sync.Mutex
+	wlock     sync.Mutex
+	sent      uint64 // sequence of the sent data
+	acked     uint64 // sequence of the data consumed by peer
+	retrans   []byte // unacknowledged data [acked, sent)
+	suspended bool   // the tun was lost, waiting for migration
+	migrated  bool   // MIGRATE was sent in this suspension
+	finished  bool   // CLOSE_W was deferred by suspension
+	released  bool   // not counted in the streams of tun
+	epoch     int    // times of suspension
+}
+
+func newEdgeConn(mux *multiplexer, sid uint16, dest string, tun *Conn, conn net.Conn, active bool) *edgeConn {
 	var edge = &edgeConn{
-		mux:  mux,
-		tun:  tun,
-		conn: conn,
-		key:  key,
+		mux:      mux,
+		tun:      tun,
+		conn:     conn,
+		key:      streamKey(sid),
+		sid:      sid,
+		active:   active,
 	}
-	if mux.isClient {
+	edge.credit = sync.NewCond(&edge.lock)
+	atomic.AddInt32(&tun.streams, 1)
+	if active {
 		edge.ready = make(chan byte, 1)
 		edge.dest = "<-" + dest
 	} else {
@@ -63,6 +82,102 @@ func (e *edgeConn) deliver(frm *frame) {
 	}
 }
 
+// deliver the data from the tun
+// the data from a stale tun will be dropped, it was or will be retransmitted.
+func (e *edgeConn) deliverData(tun *Conn, frm *frame) {
+	if q := e.queue; q != nil {
+		frm.conn = e
+		q.lock.Lock()
+		defer q.cond.Signal()
+		defer q.lock.Unlock()
+		if q.buffer != nil && q.rtun == tun {
+			q._enqueue(frm)
+		} else {
+			frm.free()
+		}
+	}
+}
+
+// the remaining credit, or 0 if the edge was closed
+func (e *edgeConn) waitCredit() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for {
+		credit := STREAM_WINDOW - int(e.sent-e.acked)
+		if credit > 0 {
+			return credit
+		}
+		if atomic.LoadUint32(&e.closed)&TCP_CLOSE_R != 0 {
+			return 0
+		}
+		e.credit.Wait()
+	}
+}
+
+// peer has consumed the data before the sequence
+// the granted sequence is absolute, so the order of arrival is irrelevant.
+func (e *edgeConn) grant(consumed uint64) {
+	e.lock.Lock()
+	if consumed > e.acked && consumed <= e.sent {
+		e.retrans = e.retrans[consumed-e.acked:]
+		e.acked = consumed
+	}
+	e.lock.Unlock()
+	e.wakeup()
+}
+
+func (e *edgeConn) getTun() *Conn {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.tun
+}
+
+// move the stream to the tun
+func (e *edgeConn) setTun(tun *Conn) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !e.released {
+		atomic.AddInt32(&e.tun.streams, -1)
+		atomic.AddInt32(&tun.streams, 1)
+	}
+	e.tun = tun
+}
+
+// uncount the stream after closed entirely
+func (e *edgeConn) release() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !e.released {
+		e.released = true
+		atomic.AddInt32(&e.tun.streams, -1)
+	}
+}
+
+// tell the dialer whether the stream was opened
+func (e *edgeConn) notifyOpen(code byte) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.opened == nil {
+		return
+	}
+	switch code {
+	case FRAME_ACTION_OPEN_Y:
+		e.opened <- nil
+	case FRAME_ACTION_OPEN_DENIED:
+		e.opened <- ERR_OPEN_DENIED
+	default:
+		e.opened <- ERR_OPEN_FAILED
+	}
+	e.opened = nil
+}
+
+// wakeup the relay waiting for credit
+func (e *edgeConn) wakeup() {
+	e.lock.Lock()
+	e.credit.Broadcast()
+	e.lock.Unlock()
+}
+
 // greater than or equals b
 func (e *edgeConn) closed_gte(b uint32) bool {
 	return atomic.LoadUint32(&e.closed) >= b
@@ -71,8 +186,11 @@ func (e *edgeConn) closed_gte(b uint32) bool {
 // read and check the mask bit, if not set then set with mask
 func (e *edgeConn) bitwiseCompareAndSet(mask uint32) bool {
 	c := atomic.LoadUint32(&e.closed)
-	if c&mask == 0 {
-		return atomic.CompareAndSwapUint32(&e.closed, c, c|mask)
+	if c&mask == 0 && atomic.CompareAndSwapUint32(&e.closed, c, c|mask) {
+		if c|mask == TCP_CLOSED {
+			e.release()
+		}
+		return true
 	}
 	return false
 }
@@ -94,12 +212,10 @@ func newEgressRouter(mux *multiplexer) *egressRouter {
 		lock:            new(sync.RWMutex),
 		mux:             mux,
 		registry:        make(map[string]*edgeConn),
+		preRegistry:     make(map[string]*list.List),
 		cleanerTicker:   time.NewTicker(TICKER_INTERVAL),
 		stopCleanerChan: make(chan bool, 1),
 	}
-	if !mux.isClient {
-		r.preRegistry = make(map[string]*list.List)
-	}
 	go r.cleanTask()
 	return r
 }
@@ -153,13 +269,13 @@ func (r *egressRouter) clean() {
 	}
 }
 
-func (r *egressRouter) register(key, destination string, tun *Conn, conn net.Conn, active bool) *edgeConn {
+func (r *egressRouter) register(sid uint16, destination string, tun *Conn, conn net.Conn, active bool) *edgeConn {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	var key = streamKey(sid)
 	var edge = r.registry[key]
 	if edge == nil {
-		edge = newEdgeConn(r.mux, key, destination, tun, conn)
-		edge.active = active
+		edge = newEdgeConn(r.mux, sid, destination, tun, conn, active)
 		edge.initEqueue()
 		r.registry[key] = edge
 	}
@@ -184,22 +300,19 @@ func (r *egressRouter) destroy() {
 	r.registry = nil
 }
 
-// remove edges (with queues) were related to the tun
-func (r *egressRouter) cleanOfTun(tun *Conn) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	var prefix = tun.identifier
-	var frm = &frame{action: FRAME_ACTION_CLOSE}
-	for k, e := range r.registry {
-		if strings.HasPrefix(k, prefix) {
-			if e.queue != nil {
-				e.queue._push(frm)
-			} else {
-				SafeClose(e.conn)
-			}
-			delete(r.registry, k)
+// migrate the edges were related to the tun
+func (r *egressRouter) migrateOfTun(tun *Conn) {
+	var related []*edgeConn
+	r.lock.RLock()
+	for _, e := range r.registry {
+		if e.getTun() == tun {
+			related = append(related, e)
 		}
 	}
+	r.lock.RUnlock()
+	for _, e := range related {
+		go e.migrate(tun)
+	}
 }
 
 func (r *egressRouter) cleanTask() {
@@ -229,10 +342,15 @@ func (r *egressRouter) stopCleanTask() {
 // Equeue
 // -------------------------------
 type equeue struct {
-	edge   *edgeConn
-	lock   sync.Locker
-	cond   *sync.Cond
-	buffer *list.List
+	edge     *edgeConn
+	lock     sync.Locker
+	cond     *sync.Cond
+	buffer   *list.List
+	pending  int    // queued data
+	recvd    uint64 // sequence of the received data
+	consumed uint64 // sequence of the data written to edge
+	granted  uint64 // the consumed sequence was told to peer
+	rtun     *Conn  // the tun which peer is sending data via
 }
 
 func (edge *edgeConn) initEqueue() *equeue {
@@ -242,6 +360,7 @@ func (edge *edgeConn) initEqueue() *equeue {
 		lock:   l,
 		cond:   sync.NewCond(l),
 		buffer: list.New(),
+		rtun:   edge.tun,
 	}
 	edge.queue = q
 	go q.sendLoop()
@@ -254,7 +373,7 @@ func (q *equeue) _push(frm *frame) {
 	defer q.lock.Unlock()
 	// push
 	if q.buffer != nil {
-		q.buffer.PushBack(frm)
+		q._enqueue(frm)
 	} // else the queue was exited
 }
 
@@ -263,15 +382,51 @@ func (q *equeue) _push_all(buffer *list.List) {
 	defer q.cond.Signal()
 	defer q.lock.Unlock()
 	// push
-	if _list := q.buffer; _list != nil {
+	if q.buffer != nil {
 		for i, e := buffer.Len(), buffer.Front(); i > 0; i, e = i-1, e.Next() {
 			f := e.Value.(*frame)
 			f.conn = q.edge
-			_list.PushBack(f)
+			q._enqueue(f)
 		}
 	} // else the queue was exited
 }
 
+// the data beyond the window means peer was misbehaving
+func (q *equeue) _enqueue(frm *frame) {
+	if frm.action == FRAME_ACTION_DATA {
+		q.recvd += uint64(frm.length)
+		q.pending += int(frm.length)
+		if q.pending > STREAM_WINDOW {
+			log.Warningln("Peer sent data beyond the window", q.edge.dest)
+			frm.free()
+			frm = &frame{action: FRAME_ACTION_CLOSE}
+		}
+	}
+	q.buffer.PushBack(frm)
+}
+
+// grant credit to peer after the data was consumed by edge
+func (q *equeue) credit(frm *frame) {
+	q.lock.Lock()
+	q.pending -= int(frm.length)
+	q.consumed += uint64(frm.length)
+	var consumed = q.consumed
+	var update = consumed-q.granted >= STREAM_WINDOW_UPDATE
+	if update {
+		q.granted = consumed
+	}
+	q.lock.Unlock()
+	if update {
+		var buf = make([]byte, FRAME_HEADER_LEN+8)
+		binary.BigEndian.PutUint64(buf[FRAME_HEADER_LEN:], consumed)
+		pack(buf, FRAME_ACTION_SLOWDOWN, frm.sid, uint16(8))
+		// lost in a broken tun, then MIGRATE will carry it
+		if tun := q.edge.getTun(); tun != nil {
+			frameWriteBuffer(tun, buf)
+		}
+	}
+}
+
 func (q *equeue) sendLoop() {
 	for {
 		var buffer *list.List
@@ -298,7 +453,7 @@ func (q *equeue) sendLoop() {
 				if werr {
 					edge := q.edge
 					if edge.bitwiseCompareAndSet(TCP_CLOSE_W) { // only actively closed can notify peer
-						tun := edge.tun
+						tun := edge.getTun()
 						// may be a broken tun
 						if tun == nil || tun.LocalAddr() == nil {
 							tun = edge.mux.pool.Select()
@@ -312,6 +467,7 @@ func (q *equeue) sendLoop() {
 					frm.free()
 					return
 				} else {
+					q.credit(frm)
 					frm.free()
 				}
 			}
@@ -345,10 +501,12 @@ func (q *equeue) _close(force bool, close_code uint) {
 	q.buffer = nil
 	if force {
 		atomic.StoreUint32(&e.closed, TCP_CLOSED)
+		e.release()
 		SafeClose(e.conn)
 	} else {
 		closeW(e.conn)
 	}
+	e.wakeup()
 }
 
 func sendFrame(frm *frame) bool {
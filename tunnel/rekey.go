@@ -0,0 +1,175 @@
+package tunnel
+
+import (
+	"io"
+	"time"
+
+	"github.com/Lafeng/deblocus/crypto"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	// rekey the written direction after the bytes or the interval by default
+	REKEY_BYTES    = 1 << 30
+	REKEY_INTERVAL = time.Hour
+	REKEY_SALT_LEN = 32
+	// the interval is also checked by mux.Listen even if nothing was written
+	REKEY_CHECK_INTERVAL = time.Minute
+)
+
+// the limits of the key, configured by RekeyBytes and RekeyInterval.
+// the zero values are the defaults.
+type rekeyLimit struct {
+	bytes    int64
+	interval time.Duration
+}
+
+func parseRekeyLimit(bytes int64, interval string) (limit rekeyLimit, err error) {
+	if bytes < 0 {
+		return limit, CONF_ERROR.Apply("RekeyBytes")
+	}
+	limit.bytes = bytes
+	if interval != NULL {
+		limit.interval, err = time.ParseDuration(interval)
+		if err != nil || limit.interval <= 0 {
+			return limit, CONF_ERROR.Apply("RekeyInterval " + interval)
+		}
+	}
+	return
+}
+
+// The keys of two directions are updated respectively.
+// The writer sends REKEY frame with a random salt by the current key,
+// then both sides ratchet the key of that direction to H(key|salt),
+// so the reader switches exactly after the REKEY frame and the streams go on.
+type rekeyer struct {
+	desc     *cipherDesc
+	isServ   bool
+	enabled  bool
+	wKey     []byte
+	rKey     []byte
+	written  int64
+	last     time.Time
+	bytes    int64
+	interval time.Duration
+}
+
+func newRekeyer(cf *CipherFactory, isServ bool) *rekeyer {
+	return &rekeyer{
+		desc:     cf.decr,
+		isServ:   isServ,
+		wKey:     append([]byte(nil), cf.key...),
+		rKey:     append([]byte(nil), cf.key...),
+		bytes:    REKEY_BYTES,
+		interval: REKEY_INTERVAL,
+	}
+}
+
+func (r *rekeyer) due(n int) bool {
+	r.written += int64(n)
+	return r.enabled && (r.written >= r.bytes || time.Since(r.last) >= r.interval)
+}
+
+// derive next key then wipe the old
+func (r *rekeyer) ratchet(key *[]byte, salt []byte) cipherKit {
+	newKey := normalizeKey(r.desc.keyLen, *key, salt)
+	crypto.Memset(*key, 0)
+	*key = newKey
+	cf := &CipherFactory{append([]byte(nil), newKey...), r.desc}
+	defer cf.Cleanup()
+	return cf.InitCipher(salt, r.isServ)
+}
+
+func (r *rekeyer) cleanup() {
+	crypto.Memset(r.wKey, 0)
+	crypto.Memset(r.rKey, 0)
+}
+
+// the kits of two directions could be replaced respectively
+type duplexCipherKit struct {
+	r cipherKit
+	w cipherKit
+}
+
+func (c *duplexCipherKit) read(r io.Reader, b []byte) (int, error) {
+	return c.r.read(r, b)
+}
+
+func (c *duplexCipherKit) write(w io.Writer, b []byte) (int, error) {
+	return c.w.write(w, b)
+}
+
+func (c *duplexCipherKit) Cleanup() {
+	c.r.Cleanup()
+	if c.w != c.r {
+		c.w.Cleanup()
+	}
+}
+
+// begin to rekey after handshake, the peer is able to recognize REKEY frame.
+func (c *Conn) startRekey(limit rekeyLimit) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if c.rekey != nil {
+		if limit.bytes > 0 {
+			c.rekey.bytes = limit.bytes
+		}
+		if limit.interval > 0 {
+			c.rekey.interval = limit.interval
+		}
+		c.rekey.enabled = true
+		c.rekey.written, c.rekey.last = 0, time.Now()
+	}
+}
+
+// rekey by the interval even if nothing was written
+func (c *Conn) rekeyIfDue() error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if c.rekey != nil && c.rekey.due(0) {
+		c.SetWriteDeadline(time.Now().Add(WRITE_TUN_TIMEOUT))
+		return c.rekeyWrite()
+	}
+	return nil
+}
+
+// send REKEY then switch the writing key, must be under wlock.
+func (c *Conn) rekeyWrite() error {
+	var salt = randArray(REKEY_SALT_LEN)
+	var buf = make([]byte, FRAME_HEADER_LEN+REKEY_SALT_LEN)
+	pack(buf, FRAME_ACTION_REKEY, 0, salt)
+	duplex := c.cipher.(*duplexCipherKit)
+	if _, err := duplex.w.write(c.Conn, frameTransform(buf)); err != nil {
+		return err
+	}
+	old := duplex.w
+	duplex.w = c.rekey.ratchet(&c.rekey.wKey, salt)
+	if old != duplex.r {
+		old.Cleanup()
+	}
+	c.rekey.written, c.rekey.last = 0, time.Now()
+	if log.V(log.LV_ACT_FRM) {
+		log.Infoln("Tun", c.identifier, "rekeyed the writing")
+	}
+	return nil
+}
+
+// received REKEY then switch the reading key
+func (c *Conn) rekeyRead(salt []byte) error {
+	if c.rekey == nil || len(salt) != REKEY_SALT_LEN {
+		return ERR_DATA_TAMPERED.Apply("rekey")
+	}
+	kit := c.rekey.ratchet(&c.rekey.rKey, append([]byte(nil), salt...))
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	duplex := c.cipher.(*duplexCipherKit)
+	old := duplex.r
+	duplex.r = kit
+	if old != duplex.w {
+		old.Cleanup()
+	}
+	if log.V(log.LV_ACT_FRM) {
+		log.Infoln("Tun", c.identifier, "rekeyed the reading")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// read frames like mux.Listen
+func readFrames(tun *Conn, data *bytes.Buffer, rekeys *int) error {
+	var header = make([]byte, FRAME_HEADER_LEN)
+	for {
+		if _, e := io.ReadFull(tun, header); e != nil {
+			return e
+		}
+		frm, e := parse_frame(header)
+		if e == nil && len(frm.data) > 0 {
+			_, e = io.ReadFull(tun, frm.data)
+			frm.data = frm.data[:frm.length]
+		}
+		if e != nil {
+			return e
+		}
+		switch frm.action {
+		case FRAME_ACTION_REKEY:
+			*rekeys++
+			if e = tun.rekeyRead(frm.data); e != nil {
+				return e
+			}
+		case FRAME_ACTION_DATA:
+			data.Write(frm.data)
+		case FRAME_ACTION_CLOSE:
+			return nil
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	for _, name := range []string{"AES128CTR", "CHACHA20POLY1305"} {
+		client, server, _ := newAEADPair(name)
+		client.startRekey(rekeyLimit{bytes: 1 << 12})
+		server.startRekey(rekeyLimit{})
+
+		var received = new(bytes.Buffer)
+		var rekeys int
+		var done = make(chan error)
+		go func() {
+			done <- readFrames(server, received, &rekeys)
+		}()
+
+		var sent = new(bytes.Buffer)
+		var oldKey = client.rekey.wKey
+		for i := 0; i < 20; i++ {
+			if i == 10 {
+				// by time
+				client.rekey.bytes = REKEY_BYTES
+				client.rekey.interval = time.Millisecond * 10
+				time.Sleep(client.rekey.interval)
+			}
+			var buf = make([]byte, FRAME_HEADER_LEN+1000)
+			pack(buf, FRAME_ACTION_DATA, 1, randArray(1000))
+			sent.Write(buf[FRAME_HEADER_LEN:])
+			client.Write(frameTransform(buf))
+		}
+		// by time without writing, see idler.checkRekey
+		var lastKey = append([]byte(nil), client.rekey.wKey...)
+		time.Sleep(client.rekey.interval)
+		if e := client.rekeyIfDue(); e != nil || bytes.Equal(lastKey, client.rekey.wKey) {
+			t.Errorf("%s not rekeyed by time error=%v", name, e)
+		}
+		// no more REKEY after CLOSE
+		client.rekey.interval = REKEY_INTERVAL
+		var buf = make([]byte, FRAME_HEADER_LEN)
+		pack(buf, FRAME_ACTION_CLOSE, 0, nil)
+		client.Write(frameTransform(buf))
+
+		if e := <-done; e != nil || !bytes.Equal(sent.Bytes(), received.Bytes()) {
+			t.Errorf("%s received %d/%d error=%v", name, received.Len(), sent.Len(), e)
+		}
+		if rekeys < 3 || !bytes.Equal(client.rekey.wKey, server.rekey.rKey) {
+			t.Errorf("%s rekeyed %d times", name, rekeys)
+		}
+		if !bytes.Equal(oldKey, make([]byte, len(oldKey))) {
+			t.Errorf("%s the old key was not wiped", name)
+		}
+		// the reverse direction was not rekeyed
+		if !bytes.Equal(client.rekey.rKey, server.rekey.wKey) || bytes.Equal(client.rekey.rKey, client.rekey.wKey) {
+			t.Errorf("%s the keys of reverse direction", name)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestParseRekeyLimit(t *testing.T) {
+	limit, e := parseRekeyLimit(0, NULL)
+	if e != nil || limit != (rekeyLimit{}) {
+		t.Errorf("default %v error=%v", limit, e)
+	}
+	limit, e = parseRekeyLimit(1<<20, "10m")
+	if e != nil || limit.bytes != 1<<20 || limit.interval != time.Minute*10 {
+		t.Errorf("configured %v error=%v", limit, e)
+	}
+	for _, interval := range []string{"1", "-1h", "0s"} {
+		if _, e = parseRekeyLimit(0, interval); e == nil {
+			t.Errorf("accepted interval %s", interval)
+		}
+	}
+	if _, e = parseRekeyLimit(-1, NULL); e == nil {
+		t.Errorf("accepted negative bytes")
+	}
+}
@@ -0,0 +1,64 @@
+package tunnel
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// a hello is acceptable in the time counters of current and +-TIME_ERROR steps,
+	// so it should be remembered for the generations of the whole window.
+	REPLAY_GENERATIONS = TIME_ERROR<<1 + 1
+	REPLAY_GEN_LIMIT   = 1 << 16
+)
+
+// The digests of dbcHello seen in the time window.
+// A generation is rotated on every updating of time counters,
+// or earlier if it was filled up, then the oldest will be dropped.
+type replayFilter struct {
+	lock    sync.Mutex
+	gens    []map[uint64]bool // newest first
+	limit   int
+	replays int64
+}
+
+func newReplayFilter() *replayFilter {
+	f := &replayFilter{limit: REPLAY_GEN_LIMIT}
+	f.gens = make([]map[uint64]bool, REPLAY_GENERATIONS)
+	for i := range f.gens {
+		f.gens[i] = make(map[uint64]bool)
+	}
+	return f
+}
+
+// record the digest and return whether it was seen before.
+func (f *replayFilter) seen(digest uint64) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, g := range f.gens {
+		if g[digest] {
+			atomic.AddInt64(&f.replays, 1)
+			return true
+		}
+	}
+	if len(f.gens[0]) >= f.limit {
+		f.rotateLocked()
+	}
+	f.gens[0][digest] = true
+	return false
+}
+
+func (f *replayFilter) rotate() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rotateLocked()
+}
+
+func (f *replayFilter) rotateLocked() {
+	copy(f.gens[1:], f.gens)
+	f.gens[0] = make(map[uint64]bool)
+}
+
+func (f *replayFilter) replayed() int64 {
+	return atomic.LoadInt64(&f.replays)
+}
@@ -0,0 +1,203 @@
+package tunnel
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ex "github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	// the streams opened by server have the highest bit of sid
+	SID_REVERSE uint16 = 0x8000
+)
+
+const (
+	// sub-commands of FRAME_ACTION_REVERSE
+	REVERSE_BIND   byte = 0x1
+	REVERSE_BIND_Y byte = 0x2
+	REVERSE_BIND_N byte = 0x3
+)
+
+var (
+	REVERSE_NOT_PERMITTED = ex.New("Reverse port is not permitted")
+)
+
+// reverse port forwarding (ssh -R style)
+// Reverse = :15432 -> 127.0.0.1:5432
+// Listen is the address to be bound in server side,
+// Target is the service reachable from client.
+type ReverseForward struct {
+	Listen string
+	Target string
+}
+
+func (f *ReverseForward) String() string {
+	return f.Listen + " " + FORWARD_SEPARATOR + " " + f.Target
+}
+
+func parseReverseForward(value string) (*ReverseForward, error) {
+	listen, target, err := parseForwardPair(value)
+	if err != nil {
+		return nil, err
+	}
+	// host is optional
+	if _, port, e := net.SplitHostPort(listen); e != nil || port == NULL {
+		return nil, CONF_ERROR.Apply("Reverse " + value)
+	}
+	return &ReverseForward{listen, target}, nil
+}
+
+// port ranges were permitted to be exposed
+type portRanges [][2]int
+
+// 15432, 20000-20010
+func parsePortRanges(value string) (portRanges, error) {
+	var ranges portRanges
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == NULL {
+			continue
+		}
+		from, to := SubstringBefore(item, "-")
+		if to == NULL {
+			to = from
+		}
+		a, e1 := strconv.Atoi(strings.TrimSpace(from))
+		b, e2 := strconv.Atoi(strings.TrimSpace(to))
+		if e1 != nil || e2 != nil || a <= 0 || a > b || b > 0xffff {
+			return nil, CONF_ERROR.Apply("Invalid ports " + item)
+		}
+		ranges = append(ranges, [2]int{a, b})
+	}
+	return ranges, nil
+}
+
+func (r portRanges) contains(port int) bool {
+	for _, pr := range r {
+		if port >= pr[0] && port <= pr[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// -------------------------------
+// reverseBinder
+// -------------------------------
+// server: the listeners were requested by the client of session
+type reverseBinder struct {
+	lock      sync.Mutex
+	mux       *multiplexer
+	listeners map[string]net.Listener
+}
+
+func newReverseBinder(mux *multiplexer) *reverseBinder {
+	return &reverseBinder{
+		mux:       mux,
+		listeners: make(map[string]net.Listener),
+	}
+}
+
+func (b *reverseBinder) bind(addr string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.listeners == nil {
+		return ILLEGAL_STATE
+	}
+	// requested repeatedly after client reconnected
+	if _, y := b.listeners[addr]; y {
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	b.listeners[addr] = ln
+	go b.acceptLoop(ln, addr)
+	return nil
+}
+
+func (b *reverseBinder) acceptLoop(ln net.Listener, addr string) {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err == nil {
+			delay = 0
+			go b.mux.HandleRequest("REVERSE", conn, addr)
+		} else if IsClosedError(err) {
+			return
+		} else {
+			delay = acceptDelay(delay)
+			log.Warningf("Reverse %s accept error=%v retry after %s\n", addr, err, delay)
+			time.Sleep(delay)
+		}
+	}
+}
+
+func (b *reverseBinder) destroy() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, ln := range b.listeners {
+		ln.Close()
+	}
+	b.listeners = nil
+}
+
+// server: REVERSE_BIND | listen address
+func (t *Session) reverseHandle(args []byte) {
+	if len(args) < 2 || args[0] != REVERSE_BIND {
+		log.Warningf("Unrecognized packet=[% x]\n", args)
+		return
+	}
+	var addr = string(args[1:])
+	var err error
+	_, port, _ := net.SplitHostPort(addr)
+	pn, _ := strconv.Atoi(port)
+	if !t.reversePorts.contains(pn) {
+		err = REVERSE_NOT_PERMITTED.Apply(addr)
+	} else {
+		err = t.reverse.bind(addr)
+	}
+	var reply = make([]byte, len(args))
+	copy(reply, args)
+	if err == nil {
+		reply[0] = REVERSE_BIND_Y
+		log.Infof("Reverse %s is listening for %s", addr, t.cid)
+	} else {
+		reply[0] = REVERSE_BIND_N
+		log.Warningf("Reverse %s for %s error: %v", addr, t.cid, err)
+	}
+	t.mux.bestSend(FRAME_ACTION_REVERSE, reply, "replyReverse")
+}
+
+// client: request server to bind the reverse listeners
+func (r *remote) requestReverse(mux *multiplexer) {
+	for _, rev := range r.client.reverse {
+		var data = append([]byte{REVERSE_BIND}, rev.Listen...)
+		if !mux.bestSend(FRAME_ACTION_REVERSE, data, "requestReverse") {
+			return
+		}
+	}
+}
+
+// client: REVERSE_BIND_Y/N | listen address
+func (c *Client) reverseReply(args []byte) {
+	if len(args) < 2 {
+		log.Warningf("Unrecognized packet=[% x]\n", args)
+		return
+	}
+	var addr = string(args[1:])
+	switch args[0] {
+	case REVERSE_BIND_Y:
+		log.Infof("Reverse %s is listening on server", addr)
+	case REVERSE_BIND_N:
+		log.Warningf("Reverse %s was refused by server", addr)
+	default:
+		log.Warningf("Unrecognized command=%x packet=[% x]\n", args[0], args)
+	}
+}
@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReverseRequest(t *testing.T) {
+	startEmulation()
+	client.reverse = map[string]string{":15432": dstAddr}
+	defer func() {
+		client.reverse = nil
+	}()
+
+	// server opens stream to the configured target of client
+	app, edge := tcpPair()
+	go server.HandleRequest("REVERSE", edge, ":15432")
+	buf0 := make([]byte, 0xffff)
+	buf1 := make([]byte, 0xffff)
+	for i := 0; i < 10; i++ {
+		n := randomBuffer(buf0)
+		_, e := app.Write(buf0[:n])
+		ThrowErr(e)
+		app.SetReadDeadline(time.Now().Add(time.Second * 5))
+		nr, e := io.ReadFull(app, buf1[:n-2])
+		if e != nil {
+			t.Fatalf("read reverse stream error %v", e)
+		}
+		if !bytes.Equal(buf0[2:n], buf1[:nr]) {
+			t.Fatalf("sent is inconsistent with recv. n=%d nr=%d", n, nr)
+		}
+	}
+	app.Close()
+	rest(2)
+	checkFinishedLength(t)
+
+	// the unconfigured must be denied by client
+	app, edge = tcpPair()
+	go server.HandleRequest("REVERSE", edge, ":15433")
+	app.Write(buf0[:8])
+	app.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if nr, e := app.Read(buf1); e != io.EOF {
+		t.Errorf("unconfigured reverse was opened nr=%d err=%v", nr, e)
+	}
+	app.Close()
+	rest(2)
+	checkFinishedLength(t)
+}
+
+func TestPortRanges(t *testing.T) {
+	r, err := parsePortRanges("15432, 20000-20010")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for port, expected := range map[int]bool{15432: true, 20005: true, 15433: false, 20011: false} {
+		if r.contains(port) != expected {
+			t.Errorf("contains(%d) != %v", port, expected)
+		}
+	}
+	if _, err = parsePortRanges("20010-20000"); err == nil {
+		t.Errorf("expected error of reversed range")
+	}
+}
+
+func TestReverseMalformed(t *testing.T) {
+	// must not panic
+	for _, args := range [][]byte{nil, {REVERSE_BIND}, {REVERSE_BIND_Y}} {
+		new(Session).reverseHandle(args)
+		new(Client).reverseReply(args)
+	}
+}
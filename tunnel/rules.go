@@ -0,0 +1,324 @@
+package tunnel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	ex "github.com/Lafeng/deblocus/exception"
+	"github.com/Lafeng/deblocus/geo"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+type ruleAction byte
+
+const (
+	RULE_PROXY ruleAction = iota
+	RULE_DIRECT
+	RULE_REJECT
+)
+
+const (
+	RULE_DOMAIN_SUFFIX  = "DOMAIN-SUFFIX"
+	RULE_DOMAIN_KEYWORD = "DOMAIN-KEYWORD"
+	RULE_IP_CIDR        = "IP-CIDR"
+	RULE_GEOIP          = "GEOIP"
+	RULE_PORT           = "PORT"
+	RULE_FINAL          = "FINAL"
+)
+
+var (
+	INVALID_RULE = ex.New("Invalid rule")
+)
+
+func (a ruleAction) String() string {
+	switch a {
+	case RULE_DIRECT:
+		return "DIRECT"
+	case RULE_REJECT:
+		return "REJECT"
+	default:
+		return "PROXY"
+	}
+}
+
+func parseRuleAction(s string) (ruleAction, bool) {
+	switch strings.ToUpper(s) {
+	case "PROXY":
+		return RULE_PROXY, true
+	case "DIRECT":
+		return RULE_DIRECT, true
+	case "REJECT":
+		return RULE_REJECT, true
+	}
+	return 0, false
+}
+
+// resolve the domain of target for the ip rules
+type ipLookup func(host string) (net.IP, error)
+
+// the destination being matched
+// ip will be resolved lazily only if the ip rules were reached
+type ruleTarget struct {
+	host     string
+	port     int
+	ip       net.IP
+	isDomain bool
+	resolved bool
+	lookup   ipLookup
+}
+
+func newRuleTarget(target string, lookup ipLookup) (*ruleTarget, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	t := &ruleTarget{host: strings.ToLower(host), lookup: lookup}
+	t.port, _ = strconv.Atoi(port)
+	if t.ip = net.ParseIP(host); t.ip == nil {
+		t.isDomain = true
+	} else {
+		t.resolved = true
+	}
+	return t, nil
+}
+
+func (t *ruleTarget) resolve() net.IP {
+	if !t.resolved {
+		t.resolved = true
+		var err error
+		if t.lookup != nil {
+			t.ip, err = t.lookup(t.host)
+		} else {
+			var addr *net.IPAddr
+			if addr, err = net.ResolveIPAddr("ip", t.host); err == nil {
+				t.ip = addr.IP
+			}
+		}
+		if err != nil && log.V(log.LV_WARN_EDGE) {
+			log.Warningln("Rules: resolve", t.host, err)
+		}
+	}
+	return t.ip
+}
+
+type rule struct {
+	kind    string
+	value   string
+	pattern string // the normalized suffix or keyword of domain rules
+	action  ruleAction
+	match   func(t *ruleTarget) bool
+}
+
+func newRule(kind, value string, action ruleAction) (*rule, error) {
+	r := &rule{kind: kind, value: value, action: action}
+	switch kind {
+	case RULE_DOMAIN_SUFFIX:
+		suffix := strings.ToLower(strings.TrimPrefix(value, "."))
+		r.pattern = suffix
+		r.match = func(t *ruleTarget) bool {
+			return t.isDomain && (t.host == suffix || strings.HasSuffix(t.host, "."+suffix))
+		}
+	case RULE_DOMAIN_KEYWORD:
+		keyword := strings.ToLower(value)
+		r.pattern = keyword
+		r.match = func(t *ruleTarget) bool {
+			return t.isDomain && strings.Contains(t.host, keyword)
+		}
+	case RULE_IP_CIDR:
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, INVALID_RULE.Apply(err)
+		}
+		r.match = func(t *ruleTarget) bool {
+			ip := t.resolve()
+			return ip != nil && ipNet.Contains(ip)
+		}
+	case RULE_GEOIP:
+		filter, err := geo.NewGeoIPFilter(value)
+		if err != nil {
+			return nil, INVALID_RULE.Apply(err)
+		}
+		r.match = func(t *ruleTarget) bool {
+			ip := t.resolve()
+			return ip != nil && filter.Match(ip)
+		}
+	case RULE_PORT:
+		ranges, err := parsePortRanges(value)
+		if err != nil || len(ranges) == 0 {
+			return nil, INVALID_RULE.Apply(value)
+		}
+		r.match = func(t *ruleTarget) bool {
+			return ranges.contains(t.port)
+		}
+	default:
+		return nil, INVALID_RULE.Apply(kind)
+	}
+	return r, nil
+}
+
+// the intranet is always bypassed like the PAC does,
+// and the private ranges match the ip literals only without resolving.
+var implicitRules = newImplicitRules()
+
+func newImplicitRules() []*rule {
+	var rules []*rule
+	for _, d := range pacLocalDomains {
+		r, _ := newRule(RULE_DOMAIN_SUFFIX, d, RULE_DIRECT)
+		rules = append(rules, r)
+	}
+	for _, c := range pacPrivateCIDRs {
+		_, ipNet, _ := net.ParseCIDR(c)
+		rules = append(rules, &rule{
+			kind:   RULE_IP_CIDR,
+			value:  c,
+			action: RULE_DIRECT,
+			match: func(t *ruleTarget) bool {
+				return !t.isDomain && ipNet.Contains(t.ip)
+			},
+		})
+	}
+	return rules
+}
+
+// ordered rules, the first matched rule determines the action
+// the format of each line is:
+//
+//	TYPE,VALUE,ACTION
+//	FINAL,ACTION
+//
+// TYPE: DOMAIN-SUFFIX, DOMAIN-KEYWORD, IP-CIDR, GEOIP, PORT
+// ACTION: PROXY, DIRECT, REJECT
+//
+// the domains are resolved for IP-CIDR and GEOIP through the DNS relay if enabled,
+// otherwise the system resolver will leak the queries.
+type RuleSet struct {
+	rules []*rule
+	final ruleAction
+}
+
+func LoadRuleSet(file string) (*RuleSet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRuleSet(f)
+}
+
+func parseRuleSet(reader io.Reader) (*RuleSet, error) {
+	var set = new(RuleSet)
+	var scanner = bufio.NewScanner(reader)
+	for ln := 1; scanner.Scan(); ln++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == NULL || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == RULE_FINAL && len(fields) == 2 {
+			if action, y := parseRuleAction(fields[1]); y {
+				set.final = action
+				continue
+			}
+		} else if len(fields) == 3 {
+			if action, y := parseRuleAction(fields[2]); y {
+				r, err := newRule(kind, fields[1], action)
+				if err != nil {
+					return nil, INVALID_RULE.Apply(err.Error() + " at line " + strconv.Itoa(ln))
+				}
+				set.rules = append(set.rules, r)
+				continue
+			}
+		}
+		return nil, INVALID_RULE.Apply("at line " + strconv.Itoa(ln))
+	}
+	return set, scanner.Err()
+}
+
+// target: host:port
+// the implicit rules precede, and nil set will proxy the others.
+func (s *RuleSet) Match(target string, lookup ipLookup) ruleAction {
+	var final = RULE_PROXY
+	if s != nil {
+		final = s.final
+	}
+	t, err := newRuleTarget(target, lookup)
+	if err != nil {
+		return final
+	}
+	var matched = firstMatched(implicitRules, t)
+	if matched == nil && s != nil {
+		matched = firstMatched(s.rules, t)
+	}
+	if matched == nil {
+		return final
+	}
+	if log.V(log.LV_REQ) {
+		log.Infof("Rule %s,%s,%s matched %s\n", matched.kind, matched.value, matched.action, target)
+	}
+	return matched.action
+}
+
+func firstMatched(rules []*rule, t *ruleTarget) *rule {
+	for _, r := range rules {
+		if r.match(t) {
+			return r
+		}
+	}
+	return nil
+}
+
+// dispatch the request according to rules
+func (c *Client) dispatch(protocol string, conn net.Conn, target string) {
+	var lookup ipLookup
+	if c.dns != nil {
+		lookup = func(host string) (net.IP, error) {
+			return c.dns.lookupIP(c.selectMux(), host)
+		}
+	}
+	switch c.rules.Match(target, lookup) {
+	case RULE_DIRECT:
+		c.directConnect(protocol, conn, target)
+	case RULE_REJECT:
+		if log.V(log.LV_REQ) {
+			log.Infof("%s->[%s] from=%s was rejected\n",
+				protocol, target, ipAddr(conn.RemoteAddr()))
+		}
+		SafeClose(conn)
+	default:
+		c.selectMux().HandleRequest(protocol, conn, target)
+	}
+}
+
+// connect to the destination locally
+func (c *Client) directConnect(protocol string, conn net.Conn, target string) {
+	dst, err := dialer.Dial("tcp", target)
+	if err != nil {
+		log.Warningf("Cannot connect to [%s] directly error: %s\n", target, err)
+		SafeClose(conn)
+		return
+	}
+	if log.V(log.LV_REQ) {
+		log.Infof("%s->[%s] from=%s DIRECT\n",
+			protocol, target, ipAddr(conn.RemoteAddr()))
+	}
+	conn.SetReadDeadline(ZERO_TIME)
+	var done = make(chan bool)
+	go func() {
+		io.Copy(dst, conn)
+		closeW(dst)
+		close(done)
+	}()
+	io.Copy(conn, dst)
+	closeW(conn)
+	<-done
+	SafeClose(dst)
+	SafeClose(conn)
+}
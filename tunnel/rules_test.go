@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRules = `
+# comment
+DOMAIN-SUFFIX, example.com, DIRECT
+DOMAIN-KEYWORD, ads, REJECT
+IP-CIDR, 10.0.0.0/8, DIRECT
+IP-CIDR, 127.0.0.0/8, DIRECT
+PORT, 25, REJECT
+FINAL, PROXY
+`
+
+func TestRuleSetMatch(t *testing.T) {
+	set, err := parseRuleSet(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, expected := range map[string]ruleAction{
+		"example.com:443":     RULE_DIRECT,
+		"www.EXAMPLE.com:80":  RULE_DIRECT,
+		"notexample.com:80":   RULE_PROXY,
+		"ads.tracker.net:443": RULE_REJECT,
+		"10.1.2.3:22":         RULE_DIRECT,
+		"[::1]:25":            RULE_REJECT,
+		"8.8.8.8:53":          RULE_PROXY,
+	} {
+		if action := set.Match(target, nil); action != expected {
+			t.Errorf("Match(%s)=%s expected %s", target, action, expected)
+		}
+	}
+
+	for _, rules := range []string{"DOMAIN,example.com,DIRECT", "IP-CIDR,10.0.0.0,DIRECT", "PORT,25,ALLOW", "FINAL"} {
+		if _, err = parseRuleSet(strings.NewReader(rules)); err == nil {
+			t.Errorf("expected error of %q", rules)
+		}
+	}
+}
+
+func TestImplicitRules(t *testing.T) {
+	var set *RuleSet
+	for target, expected := range map[string]ruleAction{
+		"192.168.1.1:80":   RULE_DIRECT,
+		"127.0.0.1:8080":   RULE_DIRECT,
+		"printer.LAN:631":  RULE_DIRECT,
+		"router.local:80":  RULE_DIRECT,
+		"8.8.8.8:53":       RULE_PROXY,
+		"intra.example:80": RULE_PROXY, // not resolved
+	} {
+		if action := set.Match(target, nil); action != expected {
+			t.Errorf("Match(%s)=%s expected %s", target, action, expected)
+		}
+	}
+
+	// resolved by the lookup instead of system resolver
+	set, _ = parseRuleSet(strings.NewReader("IP-CIDR,10.0.0.0/8,DIRECT\nFINAL,REJECT"))
+	var resolved []string
+	lookup := func(host string) (net.IP, error) {
+		resolved = append(resolved, host)
+		return net.IPv4(10, 1, 2, 3), nil
+	}
+	if action := set.Match("intra.example:80", lookup); action != RULE_DIRECT {
+		t.Errorf("Match(intra.example)=%s", action)
+	}
+	if len(resolved) != 1 || resolved[0] != "intra.example" {
+		t.Errorf("resolved %v", resolved)
+	}
+}
+
+func TestDirectDispatch(t *testing.T) {
+	startEmulation()
+	set, err := parseRuleSet(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt := &Client{rules: set}
+	app, conn := tcpPair()
+	defer app.Close()
+	go clt.dispatch("T", conn, dstAddr)
+
+	buf0 := make([]byte, 0xffff)
+	buf1 := make([]byte, 0xffff)
+	n := randomBuffer(buf0)
+	_, err = app.Write(buf0[:n])
+	ThrowErr(err)
+	app.SetReadDeadline(time.Now().Add(time.Second * 5))
+	nr, err := io.ReadFull(app, buf1[:n-2])
+	if err != nil || !bytes.Equal(buf0[2:n], buf1[:nr]) {
+		t.Errorf("direct connection nr=%d err=%v", nr, err)
+	}
+	// the tunnel was not used
+	assertLength(t, "client.registry", client.router.registry, 0)
+}
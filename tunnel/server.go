@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
@@ -22,6 +23,14 @@ const (
 	TOKENS_FLOOR       = 2
 	PARALLEL_TUN_QTY   = 2
 	TKSZ               = sha1.Size
+	// checking the idle sessions in shutdown
+	SHUTDOWN_POLL_INTERVAL = time.Millisecond * 500
+	// waiting for the client resuming after all tuns were lost
+	SESSION_KEEP_TIME = MIGRATE_TIMEOUT
+)
+
+var (
+	ERR_SERVER_CLOSED = ex.New("Server closed")
 )
 
 //
@@ -46,6 +55,9 @@ type Session struct {
 	cipherFactory *CipherFactory
 	tokens        map[string]bool
 	activeCnt     int32
+	reverse       *reverseBinder
+	reversePorts  portRanges
+	destroyOnce   sync.Once
 }
 
 func (serv *Server) NewSession(cf *CipherFactory) *Session {
@@ -58,6 +70,9 @@ func (serv *Server) NewSession(cf *CipherFactory) *Session {
 	if serv.filter != nil {
 		s.mux.filter = serv.filter
 	}
+	s.mux.dns = serv.dns
+	s.mux.rekey = serv.rekey
+	s.reverse = newReverseBinder(s.mux)
 	return s
 }
 
@@ -71,6 +86,8 @@ func (t *Session) eventHandler(e event, msg ...interface{}) {
 	switch e {
 	case evt_tokens:
 		go t.tokensHandle(msg[0].([]byte))
+	case evt_reverse:
+		go t.reverseHandle(msg[0].([]byte))
 	}
 }
 
@@ -81,7 +98,7 @@ func (t *Session) tokensHandle(args []byte) {
 		tokens := t.mgr.createTokens(t, GENERATE_TOKEN_NUM)
 		if tokens != nil {
 			tokens[0] = FRAME_ACTION_TOKEN_REPLY
-			t.mux.bestSend(tokens, "replyTokens")
+			t.mux.bestSend(FRAME_ACTION_TOKENS, tokens, "replyTokens")
 		}
 	default:
 		log.Warningf("Unrecognized command=%x packet=[% x]\n", cmd, args)
@@ -91,8 +108,7 @@ func (t *Session) tokensHandle(args []byte) {
 func (t *Session) DataTunServe(tun *Conn, isNewSession bool) {
 	defer func() {
 		if atomic.AddInt32(&t.activeCnt, -1) <= 0 {
-			t.destroy()
-			log.Infof("Client %s was offline", t.cid)
+			time.AfterFunc(SESSION_KEEP_TIME, t.offline)
 		}
 	}()
 
@@ -110,10 +126,24 @@ func (t *Session) DataTunServe(tun *Conn, isNewSession bool) {
 	}
 }
 
+// all tuns were lost, the session is kept for the client resuming,
+// then the suspended streams could be migrated to the resumed tun.
+func (t *Session) offline() {
+	if atomic.LoadInt32(&t.activeCnt) <= 0 && atomic.LoadInt32(&t.mux.status) >= 0 {
+		t.destroy()
+		log.Infof("Client %s was offline", t.cid)
+	}
+}
+
+// it may be called by Shutdown and the last tun at the same time
 func (t *Session) destroy() {
-	t.cipherFactory.Cleanup()
-	t.mgr.clearTokens(t)
-	t.mux.destroy()
+	t.destroyOnce.Do(func() {
+		t.mgr.remove(t)
+		t.cipherFactory.Cleanup()
+		t.mgr.clearTokens(t)
+		t.reverse.destroy()
+		t.mux.destroy()
+	})
 }
 
 //
@@ -130,16 +160,40 @@ type SessionContainer map[string]*Session
 //
 type SessionMgr struct {
 	container SessionContainer
+	sessions  map[*Session]bool // alive
 	lock      *sync.RWMutex
 }
 
 func NewSessionMgr() *SessionMgr {
 	return &SessionMgr{
 		container: make(SessionContainer),
+		sessions:  make(map[*Session]bool),
 		lock:      new(sync.RWMutex),
 	}
 }
 
+func (s *SessionMgr) add(session *Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[session] = true
+}
+
+func (s *SessionMgr) remove(session *Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, session)
+}
+
+func (s *SessionMgr) alive() []*Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var list = make([]*Session, 0, len(s.sessions))
+	for session := range s.sessions {
+		list = append(list, session)
+	}
+	return list
+}
+
 func (s *SessionMgr) take(token []byte) *Session {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -222,7 +276,12 @@ type Server struct {
 	tunParams  *tunParams
 	tcPool     unsafe.Pointer // *[]uint64
 	tcTicker   *time.Ticker
+	replay     *replayFilter
 	filter     Filterable
+	dns        *dnsRelay
+	lock       sync.Mutex
+	listeners  map[net.Listener]bool
+	closed     int32
 }
 
 func NewServer(cman *ConfigMan) *Server {
@@ -231,6 +290,9 @@ func NewServer(cman *ConfigMan) *Server {
 		serverConf: conf,
 		sharedKey:  preSharedKey(conf.publicKey),
 		sessionMgr: NewSessionMgr(),
+		replay:     newReplayFilter(),
+		listeners:  make(map[net.Listener]bool),
+		dns:        newServerDnsRelay(conf.Resolver),
 		tunParams: &tunParams{
 			pingInterval: DT_PING_INTERVAL,
 			parallels:    conf.Parallels,
@@ -261,10 +323,121 @@ func NewServer(cman *ConfigMan) *Server {
 	return s
 }
 
-func (t *Server) TunnelServe(raw *net.TCPConn) {
+// Serve accepts the tunnel connections on the listener until the server
+// was shut down and returns ERR_SERVER_CLOSED, or returns the error of
+// listener if it was closed by others.
+func (t *Server) Serve(ln net.Listener) error {
+	if !t.trackListener(ln, true) {
+		return ERR_SERVER_CLOSED
+	}
+	defer t.trackListener(ln, false)
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&t.closed) > 0 {
+				return ERR_SERVER_CLOSED
+			}
+			if IsClosedError(err) {
+				return err
+			}
+			delay = acceptDelay(delay)
+			log.Warningf("Accept error=%v retry after %s\n", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go t.TunnelServe(conn)
+	}
+}
+
+// Shutdown stops accepting, then closes the sessions after their streams
+// were finished. If the context expired before that, the remaining sessions
+// will be closed forcibly and the error of context is returned.
+func (t *Server) Shutdown(ctx context.Context) error {
+	t.closeListeners()
+	var ticker = time.NewTicker(SHUTDOWN_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if t.closeIdleSessions() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			t.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetDialer replaces the dialer connecting to the destinations.
+// It should be called before serving.
+func (t *Server) SetDialer(d Dialer) {
+	t.dialer = d
+}
+
+// SetUserDialer sets the dialer for the user, eg. a dedicated egress ip.
+// It should be called before serving.
+func (t *Server) SetUserDialer(user string, d Dialer) {
+	if t.egress == nil {
+		t.egress = make(map[string]Dialer)
+	}
+	t.egress[user] = d
+}
+
+func (t *Server) dialerOf(user string) Dialer {
+	if d := t.egress[user]; d != nil {
+		return d
+	}
+	return t.dialer
+}
+
+// returns false if the server was closed
+func (t *Server) trackListener(ln net.Listener, add bool) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if add {
+		if atomic.LoadInt32(&t.closed) > 0 {
+			return false
+		}
+		t.listeners[ln] = true
+	} else {
+		delete(t.listeners, ln)
+	}
+	return true
+}
+
+func (t *Server) closeListeners() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	atomic.StoreInt32(&t.closed, 1)
+	for ln := range t.listeners {
+		ln.Close()
+	}
+}
+
+// returns the count of sessions still serving streams
+func (t *Server) closeIdleSessions() int {
+	var busy int
+	for _, s := range t.sessionMgr.alive() {
+		if s.mux.streamCount() > 0 {
+			busy++
+		} else {
+			s.destroy()
+		}
+	}
+	return busy
+}
+
+// serve a tunnel connection of any kind of net.Conn
+func (t *Server) TunnelServe(raw net.Conn) {
 	var conn = NewConn(raw, nullCipherKit)
 	defer func() {
-		ex.Catch(recover(), nil)
+		if ex.Catch(recover(), nil) {
+			SafeClose(raw)
+		}
 	}()
 
 	man := &d5sman{
@@ -275,7 +448,16 @@ func (t *Server) TunnelServe(raw *net.TCPConn) {
 	tcPool := *(*[]uint64)(atomic.LoadPointer(&t.tcPool))
 	session, err := man.Connect(conn, tcPool)
 
-	if err == nil {
+	if err == nil && atomic.LoadInt32(&t.closed) > 0 {
+		// shutting down
+		if man.isNewSession {
+			session.destroy()
+		}
+		SafeClose(raw)
+	} else if err == nil {
+		if man.isNewSession {
+			t.sessionMgr.add(session)
+		}
 		go session.DataTunServe(conn, man.isNewSession)
 	} else {
 		SafeClose(raw)
@@ -300,6 +482,8 @@ func (s *Server) updateNow() {
 	tc := calculateTimeCounter(true)
 	// write atomically
 	atomic.StorePointer(&s.tcPool, unsafe.Pointer(&tc))
+	// expire the hello digests along with time counters
+	s.replay.rotate()
 }
 
 // implement Stats()
@@ -316,16 +500,14 @@ func (t *Server) Stats() string {
 	for k, n := range uniqClient {
 		buf.WriteString(fmt.Sprintf("Clt=%s Conn=%d\n", k, n))
 	}
+	buf.WriteString(fmt.Sprintf("Replay=%d\n", t.replay.replayed()))
 	return string(buf.Bytes())
 }
 
 // implement Close()
 func (t *Server) Close() {
-	uniqSession := make(map[string]byte)
-	for _, s := range t.sessionMgr.container {
-		if _, y := uniqSession[s.cid]; !y {
-			uniqSession[s.cid] = 1
-			s.destroy()
-		}
+	t.closeListeners()
+	for _, s := range t.sessionMgr.alive() {
+		s.destroy()
 	}
 }
@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// in-memory listener
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan bool
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan bool),
+	}
+}
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	c, s := net.Pipe()
+	select {
+	case l.conns <- s:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return streamAddr("pipe")
+}
+
+func newTestServer() *Server {
+	s := &Server{
+		serverConf: &serverConf{Parallels: 1},
+		sharedKey:  randArray(256),
+		sessionMgr: NewSessionMgr(),
+		replay:     newReplayFilter(),
+		listeners:  make(map[net.Listener]bool),
+	}
+	s.updateNow()
+	return s
+}
+
+func newTestSession(s *Server) *Session {
+	session := s.NewSession(NewCipherFactory("AES128CTR", []byte("test")))
+	s.sessionMgr.add(session)
+	return session
+}
+
+func TestServerShutdown(t *testing.T) {
+	srv := newTestServer()
+	ln := newPipeListener()
+	var served = make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	// unrecognized request will be closed
+	conn, e := ln.dial()
+	if e != nil {
+		t.Fatal(e)
+	}
+	go conn.Write(make([]byte, 1024))
+	conn.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT * 2))
+	if _, e = conn.Read(make([]byte, 1)); e == nil || IsTimeout(e) {
+		t.Errorf("expected the connection was closed but %v", e)
+	}
+	conn.Close()
+
+	// the session serving streams is busy
+	busy, idle := newTestSession(srv), newTestSession(srv)
+	edgeA, _ := net.Pipe()
+	tunA, _ := net.Pipe()
+	busy.mux.router.register(1, "test", NewConn(tunA, nullCipherKit), edgeA, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if e = srv.Shutdown(ctx); e != context.DeadlineExceeded {
+		t.Errorf("shutdown with a busy session error=%v", e)
+	}
+	select {
+	case e = <-served:
+		if e != ERR_SERVER_CLOSED {
+			t.Errorf("serve returned %v", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("serve was not stopped")
+	}
+	for _, s := range []*Session{busy, idle} {
+		if atomic.LoadInt32(&s.mux.status) >= 0 {
+			t.Error("session was not destroyed")
+		}
+	}
+	if n := len(srv.sessionMgr.alive()); n != 0 {
+		t.Errorf("alive sessions=%d", n)
+	}
+
+	// idle sessions are closed at once
+	idle = newTestSession(srv)
+	if e = srv.Shutdown(context.Background()); e != nil || atomic.LoadInt32(&idle.mux.status) >= 0 {
+		t.Errorf("shutdown with an idle session error=%v", e)
+	}
+	if e = srv.Serve(newPipeListener()); e != ERR_SERVER_CLOSED {
+		t.Errorf("serve after shutdown returned %v", e)
+	}
+}
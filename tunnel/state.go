@@ -0,0 +1,204 @@
+package tunnel
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// state of the connection to a server
+//
+//	OFFLINE -> CONNECTING -> AUTHENTICATING -> ONLINE <-> DEGRADED
+//	   ^            |               |            |            |
+//	   +------------+---------------+------------+------------+
+//
+// Any state may turn into SHUTTING_DOWN, which is final.
+type ClientState int32
+
+const (
+	CLT_OFFLINE ClientState = iota
+	CLT_CONNECTING
+	CLT_AUTHENTICATING
+	CLT_ONLINE
+	CLT_DEGRADED // some of the tuns were lost
+	CLT_SHUTTING_DOWN
+)
+
+var clientStateNames = [...]string{
+	CLT_OFFLINE:        "Offline",
+	CLT_CONNECTING:     "Connecting",
+	CLT_AUTHENTICATING: "Authenticating",
+	CLT_ONLINE:         "Online",
+	CLT_DEGRADED:       "Degraded",
+	CLT_SHUTTING_DOWN:  "ShuttingDown",
+}
+
+var clientTransitions = map[ClientState][]ClientState{
+	CLT_OFFLINE:        {CLT_CONNECTING},
+	CLT_CONNECTING:     {CLT_AUTHENTICATING, CLT_OFFLINE},
+	CLT_AUTHENTICATING: {CLT_ONLINE, CLT_OFFLINE},
+	CLT_ONLINE:         {CLT_DEGRADED, CLT_OFFLINE},
+	CLT_DEGRADED:       {CLT_ONLINE, CLT_OFFLINE},
+}
+
+func (s ClientState) String() string {
+	if s >= 0 && int(s) < len(clientStateNames) {
+		return clientStateNames[s]
+	}
+	return "Unknown"
+}
+
+// could serve the requests
+func (s ClientState) available() bool {
+	return s == CLT_ONLINE || s == CLT_DEGRADED
+}
+
+type StateEvent struct {
+	Server string // the address of server
+	From   ClientState
+	To     ClientState
+	Time   time.Time
+	Err    error // the cause of failure if any
+}
+
+// the listener is called synchronously in order of transitions,
+// so it should return quickly.
+type StateListener func(ev *StateEvent)
+
+// subscriptions of state events
+type stateHub struct {
+	lock      sync.Mutex
+	seq       int
+	listeners map[int]StateListener
+}
+
+func newStateHub() *stateHub {
+	return &stateHub{listeners: make(map[int]StateListener)}
+}
+
+// returns the function to cancel the subscription
+func (h *stateHub) subscribe(fn StateListener) (cancel func()) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.seq++
+	var id = h.seq
+	h.listeners[id] = fn
+	return func() {
+		h.lock.Lock()
+		delete(h.listeners, id)
+		h.lock.Unlock()
+	}
+}
+
+func (h *stateHub) publish(ev *StateEvent) {
+	h.lock.Lock()
+	var listeners = make([]StateListener, 0, len(h.listeners))
+	for _, fn := range h.listeners {
+		listeners = append(listeners, fn)
+	}
+	h.lock.Unlock()
+	for _, fn := range listeners {
+		fn(ev)
+	}
+}
+
+type stateMachine struct {
+	lock   sync.Mutex
+	state  int32
+	rounds int32 // count of logins
+	name   string
+	hub    *stateHub
+}
+
+func newStateMachine(name string, hub *stateHub) *stateMachine {
+	return &stateMachine{
+		state: int32(CLT_OFFLINE),
+		name:  name,
+		hub:   hub,
+	}
+}
+
+func (m *stateMachine) current() ClientState {
+	return ClientState(atomic.LoadInt32(&m.state))
+}
+
+func (m *stateMachine) round() int32 {
+	return atomic.LoadInt32(&m.rounds)
+}
+
+// move to the state if it's allowed from the current one.
+// returns false if the transition was rejected, then nothing changed.
+func (m *stateMachine) transit(to ClientState) bool {
+	return m.transitBy(to, nil)
+}
+
+// failed to connect or login, then turn offline with the error
+func (m *stateMachine) fail(err error) bool {
+	return m.transitBy(CLT_OFFLINE, err)
+}
+
+func (m *stateMachine) transitBy(to ClientState, err error) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var from = m.current()
+	if to != CLT_SHUTTING_DOWN {
+		var allowed bool
+		for _, s := range clientTransitions[from] {
+			if s == to {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	} else if from == CLT_SHUTTING_DOWN {
+		return false
+	}
+	if from == CLT_AUTHENTICATING && to == CLT_ONLINE {
+		atomic.AddInt32(&m.rounds, 1)
+	}
+	atomic.StoreInt32(&m.state, int32(to))
+	if m.hub != nil {
+		// published under the lock to keep the order of events
+		m.hub.publish(&StateEvent{
+			Server: m.name,
+			From:   from,
+			To:     to,
+			Time:   time.Now(),
+			Err:    err,
+		})
+	}
+	return true
+}
+
+// exponential backoff with equal jitter
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	attempt uint
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	if max < base {
+		max = base
+	}
+	return &backoff{base: base, max: max}
+}
+
+// the interval before next retry
+// grows twice each time, and the half of it is random.
+func (b *backoff) next() time.Duration {
+	var d = b.base << b.attempt
+	if d <= 0 || d >= b.max {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	var half = int64(d / 2)
+	return time.Duration(half + myRand.Int63n(half+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"net"
+
+	ex "github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+var (
+	TPROXY_UNSUPPORTED = ex.New("Transparent proxy is unsupported on this platform")
+	TPROXY_NO_ORIG_DST = ex.New("Transparent proxy: no original destination")
+)
+
+// serve the connection redirected by netfilter (iptables REDIRECT/TPROXY)
+// the original destination was read from the socket then go into tunnel directly
+func (c *Client) TransparentServe(conn *net.TCPConn) {
+	var done bool
+	defer func() {
+		ex.Catch(recover(), nil)
+		if !done {
+			SafeClose(conn)
+		}
+	}()
+
+	dst, err := originalDestination(conn)
+	if err != nil {
+		log.Warningln(err, "from", conn.RemoteAddr())
+		return
+	}
+	c.dispatch("TPROXY", conn, dst.String())
+	done = true
+}
+
+// REDIRECT: read SO_ORIGINAL_DST from the conntrack of socket
+// TPROXY: the local address is the original destination
+func originalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	dst, err := getOriginalDst(conn)
+	if err != nil {
+		if err == TPROXY_UNSUPPORTED || local == nil {
+			return nil, err
+		}
+		dst = local
+	}
+	// connected to the listener directly, avoid infinite loop
+	if local != nil && dst.Port == local.Port && dst.IP.Equal(local.IP) {
+		return nil, TPROXY_NO_ORIG_DST.Apply(dst)
+	}
+	return dst, nil
+}
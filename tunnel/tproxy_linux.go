@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// linux/netfilter_ipv4.h
+	SO_ORIGINAL_DST = 80
+	// linux/netfilter_ipv6/ip6_tables.h
+	IP6T_SO_ORIGINAL_DST = 80
+)
+
+func getOriginalDst(conn *net.TCPConn) (dst *net.TCPAddr, err error) {
+	var ipv6 bool
+	if local, y := conn.LocalAddr().(*net.TCPAddr); y {
+		ipv6 = local.IP.To4() == nil
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	// borrow the getsockopt of fixed size structures
+	// which are large enough to hold sockaddr_in and sockaddr_in6
+	ctrlErr := raw.Control(func(fd uintptr) {
+		if ipv6 {
+			var info *syscall.IPv6MTUInfo
+			info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST)
+			if err == nil {
+				// sin6_port was in network byte order
+				addr := &info.Addr
+				port := (*[2]byte)(unsafe.Pointer(&addr.Port))
+				dst = &net.TCPAddr{
+					IP:   append(net.IP{}, addr.Addr[:]...),
+					Port: int(binary.BigEndian.Uint16(port[:])),
+				}
+			}
+		} else {
+			var mreq *syscall.IPv6Mreq
+			mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+			if err == nil {
+				// sockaddr_in: family~2 | port~2 | addr~4
+				sa := mreq.Multiaddr[:]
+				dst = &net.TCPAddr{
+					IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+					Port: int(binary.BigEndian.Uint16(sa[2:])),
+				}
+			}
+		}
+	})
+	if err == nil {
+		err = ctrlErr
+	}
+	return
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package tunnel
+
+import (
+	"net"
+)
+
+func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, TPROXY_UNSUPPORTED
+}
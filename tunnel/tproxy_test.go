@@ -0,0 +1,17 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTransparentDirectConn(t *testing.T) {
+	a, b := tcpPair()
+	defer a.Close()
+	defer b.Close()
+	// not redirected, must not loop back to the listener
+	dst, err := originalDestination(b.(*net.TCPConn))
+	if err == nil {
+		t.Errorf("direct connection got original destination %s", dst)
+	}
+}
@@ -0,0 +1,440 @@
+package tunnel
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ex "github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	UDP_ASSOC_IDLE_TIMEOUT = time.Minute * 2
+	// reserved space before datagram: header + atyp + ipv6 + port
+	UDP_HEAD_ROOM = FRAME_HEADER_LEN + 1 + net.IPv6len + 2
+	// rsv(2) + frag(1) of socks5 udp request header
+	UDP_SOCKS_RSV = 3
+	// the resolved destinations kept by an association
+	UDP_ASSOC_MAX_DESTS = 256
+	// the datagrams waiting for resolving destinations, the more are dropped
+	UDP_ASSOC_QUEUE_LEN = 64
+)
+
+var (
+	INVALID_UDP_HEADER = ex.New("Invalid socks5 udp header")
+)
+
+// --------------------
+// udpAssociation
+// --------------------
+// Relay datagrams of a SOCKS5 UDP ASSOCIATE through the tunnel.
+// Client: conn is the local relay socket, ctrl is the controlling connection.
+// Server: conn is the outbound socket for all destinations.
+type udpAssociation struct {
+	mux    *multiplexer
+	router *udpRouter
+	tun    *Conn
+	conn   *net.UDPConn
+	ctrl   net.Conn
+	lock   sync.Mutex
+	peer   *net.UDPAddr
+	dests  map[string]*net.UDPAddr // resolved destinations
+	queue  chan []byte             // server: datagrams to destinations
+	done   chan struct{}
+	key    string
+	sid    uint16
+	last   int64
+	closed int32
+}
+
+func newUdpAssociation(router *udpRouter, key string, sid uint16, tun *Conn, conn *net.UDPConn) *udpAssociation {
+	a := &udpAssociation{
+		mux:    router.mux,
+		router: router,
+		tun:    tun,
+		conn:   conn,
+		key:    key,
+		sid:    sid,
+	}
+	if !router.mux.isClient {
+		a.dests = make(map[string]*net.UDPAddr)
+		a.queue = make(chan []byte, UDP_ASSOC_QUEUE_LEN)
+		a.done = make(chan struct{})
+	}
+	a.touch()
+	return a
+}
+
+func (a *udpAssociation) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *udpAssociation) isIdle() bool {
+	return time.Now().UnixNano()-atomic.LoadInt64(&a.last) >= int64(UDP_ASSOC_IDLE_TIMEOUT)
+}
+
+// client: read datagrams from the socks client then send to the tunnel
+func (a *udpAssociation) relayFromPeer() {
+	var (
+		buf    = bytePool.Get(FRAME_MAX_LEN)
+		ctrlIP = ipAddr(a.ctrl.RemoteAddr())
+	)
+	defer func() {
+		bytePool.Put(buf)
+		a.close(true)
+	}()
+	// the socks header rsv|frag will be overwritten by frame header
+	var dataBuf = buf[FRAME_HEADER_LEN-UDP_SOCKS_RSV:]
+	for {
+		a.conn.SetReadDeadline(time.Now().Add(UDP_ASSOC_IDLE_TIMEOUT))
+		nr, from, er := a.conn.ReadFromUDP(dataBuf)
+		if er != nil {
+			if IsTimeout(er) && !a.isIdle() {
+				continue
+			}
+			return
+		}
+		// only accept datagrams from the requester of association
+		if from.IP.String() != ctrlIP {
+			continue
+		}
+		// not support fragmentation
+		if nr <= UDP_SOCKS_RSV || dataBuf[2] != 0 {
+			if log.V(log.LV_WARN) {
+				log.Warningln(INVALID_UDP_HEADER, "from", from)
+			}
+			continue
+		}
+		if _, _, e := parseSocksAddr(buf[FRAME_HEADER_LEN : FRAME_HEADER_LEN+nr-UDP_SOCKS_RSV]); e != nil {
+			if log.V(log.LV_WARN) {
+				log.Warningln(INVALID_UDP_HEADER, "from", from)
+			}
+			continue
+		}
+		a.lock.Lock()
+		a.peer = from
+		a.lock.Unlock()
+		a.touch()
+		_len := pack(buf, FRAME_ACTION_UDP_DATA, a.sid, uint16(nr-UDP_SOCKS_RSV))
+		if frameWriteBuffer(a.tun, buf[:_len]) != nil {
+			return
+		}
+	}
+}
+
+// server: read datagrams from destinations then send to the tunnel
+func (a *udpAssociation) relayFromDest() {
+	var buf = bytePool.Get(FRAME_MAX_LEN)
+	defer func() {
+		bytePool.Put(buf)
+		a.close(true)
+	}()
+	for {
+		a.conn.SetReadDeadline(time.Now().Add(UDP_ASSOC_IDLE_TIMEOUT))
+		nr, from, er := a.conn.ReadFromUDP(buf[UDP_HEAD_ROOM:])
+		if er != nil {
+			if IsTimeout(er) && !a.isIdle() {
+				continue
+			}
+			return
+		}
+		a.touch()
+		// prepend source address
+		addr := socksAddrOf(from)
+		pos := UDP_HEAD_ROOM - len(addr) - FRAME_HEADER_LEN
+		copy(buf[pos+FRAME_HEADER_LEN:], addr)
+		pack(buf[pos:], FRAME_ACTION_UDP_DATA, a.sid, uint16(len(addr)+nr))
+		if frameWriteBuffer(a.tun, buf[pos:UDP_HEAD_ROOM+nr]) != nil {
+			return
+		}
+	}
+}
+
+// client: write the datagram from tunnel to the socks client
+func (a *udpAssociation) writeToPeer(data []byte) {
+	a.lock.Lock()
+	peer := a.peer
+	a.lock.Unlock()
+	if peer == nil {
+		return
+	}
+	buf := bytePool.Get(len(data) + UDP_SOCKS_RSV)
+	defer bytePool.Put(buf)
+	buf[0], buf[1], buf[2] = 0, 0, 0
+	copy(buf[UDP_SOCKS_RSV:], data)
+	if _, err := a.conn.WriteToUDP(buf, peer); err == nil {
+		a.touch()
+	} else if log.V(log.LV_WARN_EDGE) {
+		log.Warningf("Write udp (%s) error (%v)\n", peer, err)
+	}
+}
+
+// server: queue the datagram from tunnel, then the destination will be resolved
+// by relayToDest rather than blocking the tun reading.
+func (a *udpAssociation) queueToDest(data []byte) {
+	buf := bytePool.Get(len(data))
+	copy(buf, data)
+	select {
+	case a.queue <- buf:
+	default:
+		bytePool.Put(buf)
+		if log.V(log.LV_WARN_EDGE) {
+			log.Warningln("Drop udp datagram for", a.key)
+		}
+	}
+}
+
+// server: write the queued datagrams to destinations
+func (a *udpAssociation) relayToDest() {
+	for {
+		select {
+		case buf := <-a.queue:
+			a.writeToDest(buf)
+			bytePool.Put(buf)
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// server: write the datagram from tunnel to the destination
+func (a *udpAssociation) writeToDest(data []byte) {
+	target, n, err := parseSocksAddr(data)
+	if err != nil {
+		if log.V(log.LV_WARN) {
+			log.Warningln(INVALID_UDP_HEADER, "for", a.key)
+		}
+		return
+	}
+	a.lock.Lock()
+	dest := a.dests[target]
+	a.lock.Unlock()
+	if dest == nil {
+		if filter := a.mux.filter; filter != nil && filter.Filter(target) {
+			log.Warningf("Denied udp request [%s] for %s\n", target, a.key)
+			return
+		}
+		dest, err = net.ResolveUDPAddr("udp", target)
+		if err != nil {
+			log.Warningf("Cannot resolve udp [%s] for %s error: %s\n", target, a.key, err)
+			return
+		}
+		a.lock.Lock()
+		// drop an arbitrary one, it will be resolved again if necessary
+		for k := range a.dests {
+			if len(a.dests) < UDP_ASSOC_MAX_DESTS {
+				break
+			}
+			delete(a.dests, k)
+		}
+		a.dests[target] = dest
+		a.lock.Unlock()
+	}
+	if _, err = a.conn.WriteToUDP(data[n:], dest); err == nil {
+		a.touch()
+	} else if log.V(log.LV_WARN_EDGE) {
+		log.Warningf("Write udp (%s) error (%v)\n", target, err)
+	}
+}
+
+// notify: tell peer to release the association
+func (a *udpAssociation) close(notify bool) {
+	if !atomic.CompareAndSwapInt32(&a.closed, 0, 1) {
+		return
+	}
+	a.router.unregister(a)
+	if a.done != nil {
+		close(a.done)
+	}
+	a.conn.Close()
+	SafeClose(a.ctrl)
+	if notify {
+		buf := make([]byte, FRAME_HEADER_LEN)
+		pack(buf, FRAME_ACTION_UDP_CLOSE, a.sid, nil)
+		frameWriteBuffer(a.tun, buf)
+	}
+	if log.V(log.LV_ACT_FRM) {
+		log.Infoln("Close udp association", a.key)
+	}
+}
+
+// client: serve an UDP ASSOCIATE request
+// the association lives until the controlling connection was closed or idle
+func (p *multiplexer) HandleUDPAssociate(ctrl net.Conn, relay *net.UDPConn) {
+	p.sLock.Lock()
+	router := p.udpRouter
+	p.sLock.Unlock()
+	var tun *Conn
+	if router != nil {
+		tun = p.pool.Select()
+	}
+	if tun == nil {
+		// offline
+		log.Warningln(ERR_TUN_NA)
+		relay.Close()
+		SafeClose(ctrl)
+		return
+	}
+	sid := p.allocSid(false)
+	if sid == 0 {
+		log.Warningln("No free sid for udp association")
+		relay.Close()
+		SafeClose(ctrl)
+		return
+	}
+	key := streamKey(sid)
+	assoc := newUdpAssociation(router, key, sid, tun, relay)
+	assoc.ctrl = ctrl
+	if !router.register(assoc) {
+		relay.Close()
+		SafeClose(ctrl)
+		return
+	}
+	if log.V(log.LV_REQ) {
+		log.Infof("UDP->[%s] from=%s sid=%d\n",
+			relay.LocalAddr(), ipAddr(ctrl.RemoteAddr()), sid)
+	}
+	go assoc.relayFromPeer()
+	// wait for the controlling connection closing
+	ctrl.SetReadDeadline(ZERO_TIME)
+	io.Copy(ioutil.Discard, ctrl)
+	assoc.close(true)
+}
+
+// ------------------------------
+// udpRouter
+// ------------------------------
+type udpRouter struct {
+	lock     sync.Mutex
+	mux      *multiplexer
+	registry map[string]*udpAssociation
+}
+
+func newUdpRouter(mux *multiplexer) *udpRouter {
+	return &udpRouter{
+		mux:      mux,
+		registry: make(map[string]*udpAssociation),
+	}
+}
+
+func (r *udpRouter) register(a *udpAssociation) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.registry == nil {
+		return false
+	}
+	r.registry[a.key] = a
+	return true
+}
+
+func (r *udpRouter) unregister(a *udpAssociation) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.registry[a.key] == a {
+		delete(r.registry, a.key)
+	}
+}
+
+func (r *udpRouter) len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.registry)
+}
+
+func (r *udpRouter) get(key string) *udpAssociation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.registry[key]
+}
+
+// server: open an association on the first datagram
+// the socket is bound as the egress, which refuses udp if it's a proxy chain.
+func (r *udpRouter) open(key string, sid uint16, tun *Conn) *udpAssociation {
+	laddr, ok := udpLocalAddr(r.mux.dialer)
+	if !ok {
+		log.Warningf("Refused udp association for %s via the egress proxy\n", key)
+		r.refuse(sid, tun)
+		return nil
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		log.Warningf("Cannot open udp association for %s error: %s\n", key, err)
+		r.refuse(sid, tun)
+		return nil
+	}
+	assoc := newUdpAssociation(r, key, sid, tun, conn)
+	if !r.register(assoc) {
+		conn.Close()
+		return nil
+	}
+	if log.V(log.LV_SVR_OPEN) {
+		log.Infoln("UDP ASSOCIATE", conn.LocalAddr(), "for", key)
+	}
+	go assoc.relayFromDest()
+	go assoc.relayToDest()
+	return assoc
+}
+
+// tell peer to release the association which couldn't be opened
+func (r *udpRouter) refuse(sid uint16, tun *Conn) {
+	buf := make([]byte, FRAME_HEADER_LEN)
+	pack(buf, FRAME_ACTION_UDP_CLOSE, sid, nil)
+	frameWriteBuffer(tun, buf)
+}
+
+// route the datagram frame to its association
+func (r *udpRouter) deliver(key string, frm *frame, tun *Conn) {
+	defer frm.free()
+	assoc := r.get(key)
+	if r.mux.isClient {
+		if assoc != nil {
+			assoc.writeToPeer(frm.data)
+		} else if log.V(log.LV_WARN) {
+			log.Warningln("Peer sent datagram to an unexisted association.", key, frm)
+		}
+	} else {
+		if assoc == nil {
+			assoc = r.open(key, frm.sid, tun)
+		}
+		if assoc != nil {
+			assoc.queueToDest(frm.data)
+		}
+	}
+}
+
+// the association was released by peer
+func (r *udpRouter) remove(key string) {
+	if assoc := r.get(key); assoc != nil {
+		assoc.close(false)
+	}
+}
+
+// close the associations were related to the tun
+func (r *udpRouter) cleanOfTun(tun *Conn) {
+	var related []*udpAssociation
+	r.lock.Lock()
+	for _, a := range r.registry {
+		if a.tun == tun {
+			related = append(related, a)
+		}
+	}
+	r.lock.Unlock()
+	for _, a := range related {
+		a.close(false)
+	}
+}
+
+// destroy whole router
+func (r *udpRouter) destroy() {
+	r.lock.Lock()
+	var all = r.registry
+	r.registry = nil
+	r.lock.Unlock()
+	for _, a := range all {
+		a.close(false)
+	}
+}
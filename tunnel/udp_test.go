@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func startUdpEchoSvr(t *testing.T) *net.UDPConn {
+	conn, e := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3)})
+	ThrowErr(e)
+	go func() {
+		buf := make([]byte, 0xffff)
+		for {
+			n, from, e := conn.ReadFromUDP(buf)
+			if e != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn
+}
+
+// returns the both side of a tcp connection
+func tcpPair() (net.Conn, net.Conn) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	ThrowErr(e)
+	defer ln.Close()
+	a, e := net.Dial("tcp", ln.Addr().String())
+	ThrowErr(e)
+	b, e := ln.Accept()
+	ThrowErr(e)
+	return a, b
+}
+
+func TestUDPAssociate(t *testing.T) {
+	startEmulation()
+	echo := startUdpEchoSvr(t)
+	defer echo.Close()
+
+	ctrl, peerCtrl := tcpPair()
+	relay, e := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	ThrowErr(e)
+	go client.HandleUDPAssociate(peerCtrl, relay)
+	rest(1)
+
+	app, e := net.DialUDP("udp", nil, relay.LocalAddr().(*net.UDPAddr))
+	ThrowErr(e)
+	defer app.Close()
+
+	header := append([]byte{0, 0, 0}, socksAddrOf(echo.LocalAddr().(*net.UDPAddr))...)
+	buf := make([]byte, 0xffff)
+	for i := 0; i < 10; i++ {
+		payload := randArray(int(randomRange(1, 1<<12)))
+		_, e = app.Write(append(header, payload...))
+		ThrowErr(e)
+		app.SetReadDeadline(time.Now().Add(time.Second * 3))
+		n, e := app.Read(buf)
+		if e != nil {
+			t.Fatalf("read reply error %v", e)
+		}
+		if !bytes.Equal(buf[:len(header)], header) {
+			t.Fatalf("incorrect reply header [% x]", buf[:len(header)])
+		}
+		if !bytes.Equal(buf[len(header):n], payload) {
+			t.Fatalf("sent is inconsistent with recv. nw=%d nr=%d", len(payload), n-len(header))
+		}
+	}
+
+	assertUdpRegistry(t, 1)
+	// association terminates with the controlling connection
+	ctrl.Close()
+	rest(2)
+	assertUdpRegistry(t, 0)
+}
+
+// the server refuses udp if the egress is a proxy chain
+func TestUDPRefusedByProxyEgress(t *testing.T) {
+	startEmulation()
+	defer func(d Dialer) { server.dialer = d }(server.dialer)
+	server.dialer, _ = NewDialer("socks5://127.0.0.1:1080")
+
+	ctrl, peerCtrl := tcpPair()
+	defer ctrl.Close()
+	relay, e := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	ThrowErr(e)
+	go client.HandleUDPAssociate(peerCtrl, relay)
+	rest(1)
+
+	app, e := net.DialUDP("udp", nil, relay.LocalAddr().(*net.UDPAddr))
+	ThrowErr(e)
+	defer app.Close()
+	dest := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 53}
+	_, e = app.Write(append(append([]byte{0, 0, 0}, socksAddrOf(dest)...), 1))
+	ThrowErr(e)
+
+	// the association was released by server
+	ctrl.SetReadDeadline(time.Now().Add(time.Second * 3))
+	if _, e = ctrl.Read(make([]byte, 1)); e == nil || IsTimeout(e) {
+		t.Errorf("expected the controlling connection was closed but %v", e)
+	}
+	rest(1)
+	assertUdpRegistry(t, 0)
+}
+
+// the registries are read under the locks
+func assertUdpRegistry(t *testing.T, expected int) {
+	if n := client.udpRouter.len(); n != expected {
+		t.Errorf("len(client.udpRegistry) = %d", n)
+	}
+	if n := server.udpRouter.len(); n != expected {
+		t.Errorf("len(server.udpRegistry) = %d", n)
+	}
+}
+
+func TestUDPDestsBounded(t *testing.T) {
+	mux := newServerMultiplexer()
+	conn, e := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	ThrowErr(e)
+	assoc := newUdpAssociation(mux.udpRouter, "test", 1, nil, conn)
+	defer conn.Close()
+	for i := 0; i < UDP_ASSOC_MAX_DESTS*2; i++ {
+		dest := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000 + i}
+		assoc.writeToDest(append(socksAddrOf(dest), 0))
+	}
+	assertLength(t, "assoc.dests", assoc.dests, UDP_ASSOC_MAX_DESTS)
+}
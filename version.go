@@ -12,7 +12,7 @@ const (
 
 const (
 	ver_major uint8  = 0
-	ver_minor uint8  = 13
+	ver_minor uint8  = 14
 	ver_build uint16 = 6250 // echo $((`date +%-j`+365))
 )
 